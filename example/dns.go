@@ -1,16 +1,133 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
 	"github.com/neo-hu/network-probe-tool/network/dns"
 	"log"
+	"net/http"
+	"os"
+	"strings"
 )
 
 func main() {
-	elapsed, rs, err := dns.NewDNS("8.8.8.8", dns.NetworkOption("tcp")).
-		Exchange("ip8.me", dns.TypeANY)
-	if err != nil {
+	var nameserver = "8.8.8.8"
+	var network = "udp"
+	var typ = "A"
+	flag.StringVar(&nameserver, "s", nameserver, "nameserver, ip, ip:port or DoH url, e.g. https://dns.google/dns-query")
+	flag.StringVar(&network, "n", network, "network: udp, tcp or tcp-tls")
+	flag.StringVar(&typ, "t", typ, "query type, e.g. A, AAAA, MX, NS, SOA, TXT, ANY")
+	var dnssec, validate bool
+	var anchor string
+	flag.BoolVar(&dnssec, "dnssec", false, "set the DO bit")
+	flag.BoolVar(&validate, "validate", false, "validate the chain of trust, default from the root trust anchors")
+	flag.StringVar(&anchor, "anchor", "", "file of DS records used as trust anchors, implies -validate")
+	var sni, pin, ca string
+	var get, fallback bool
+	flag.StringVar(&sni, "sni", "", "tls server name, implies DoT if the nameserver is not a DoH url")
+	flag.StringVar(&pin, "pin", "", "base64 sha256 of the server public key")
+	flag.StringVar(&ca, "ca", "", "file of PEM root certificates for DoT and DoH")
+	flag.BoolVar(&get, "get", false, "use GET instead of POST for DoH")
+	flag.BoolVar(&fallback, "fallback", false, "retry over tcp if the udp response is truncated")
+	var compare, zone string
+	flag.StringVar(&compare, "compare", "", "comma separated nameservers to compare")
+	flag.StringVar(&zone, "zone", "", "compare all NS of the zone, discovered through -s")
+	flag.Parse()
+	name := flag.Arg(0)
+	if name == "" {
+		name = "ip8.me"
+	}
+	t, ok := dns.ParseType(typ)
+	if !ok {
+		log.Fatalf("unknown type %q", typ)
+	}
+	opts := []dns.Option{dns.NetworkOption(network)}
+	if dnssec {
+		opts = append(opts, dns.DNSSECOption())
+	}
+	if sni != "" || ca != "" {
+		config := &tls.Config{ServerName: sni}
+		if ca != "" {
+			b, err := os.ReadFile(ca)
+			if err != nil {
+				log.Fatal(err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			config.RootCAs.AppendCertsFromPEM(b)
+		}
+		opts = append(opts, dns.TLSOption(config))
+	}
+	if pin != "" {
+		opts = append(opts, dns.PinOption(pin))
+	}
+	if get {
+		opts = append(opts, dns.HTTPMethodOption(http.MethodGet))
+	}
+	if fallback {
+		opts = append(opts, dns.TCPFallbackOption())
+	}
+	if anchor != "" {
+		b, err := os.ReadFile(anchor)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var anchors []*dns.DS
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			ds, err := dns.ParseTrustAnchor(line)
+			if err != nil {
+				log.Fatal(err)
+			}
+			anchors = append(anchors, ds)
+		}
+		opts = append(opts, dns.ValidateOption(anchors...))
+	} else if validate {
+		opts = append(opts, dns.ValidateOption())
+	}
+	if compare != "" || zone != "" {
+		var nameservers []dns.Nameserver
+		if compare != "" {
+			nameservers = dns.Nameservers(strings.Split(compare, ",")...)
+		} else {
+			var err error
+			nameservers, err = dns.NewDNS(nameserver, opts...).DiscoverNameservers(context.Background(), zone)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Print(dns.Compare(context.Background(), nameservers, name, t, opts...))
+		return
+	}
+	r, err := dns.NewDNS(nameserver, opts...).Query(name, t)
+	if r == nil {
 		log.Fatal(err)
 	}
-	fmt.Println(elapsed, rs)
+	if err != nil {
+		// 被截断的时候同时返回已经收到的响应
+		fmt.Println("error:", err)
+	}
+	fmt.Printf("%s rtt=%v flags=%+v\n", r.RcodeString(), r.RTT, r.Flags)
+	if r.TLS != nil {
+		fmt.Printf("tls version=%x\n", r.TLS.Version)
+	}
+	if u := r.TruncatedUDP; u != nil {
+		fmt.Printf("truncated over udp with %d records, retried over tcp\nudp rtt=%v\n%v", len(u.Answer()), u.RTT, u.Timing)
+		fmt.Printf("tcp rtt=%v\n", r.RTT)
+	}
+	fmt.Println(r.Timing)
+	for _, record := range r.Records {
+		fmt.Printf("%-10s %s\n", record.Section, record)
+	}
+	fmt.Println(r.Strings(t))
+	if v := r.Validation; v != nil {
+		fmt.Println("dnssec:", v.Status)
+		for _, link := range v.Chain {
+			fmt.Println("  ", link)
+		}
+		if v.Failed != nil {
+			fmt.Println("failed:", *v.Failed)
+		}
+	}
 }
@@ -1,95 +1,206 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/neo-hu/network-probe-tool/network/dns"
 	"github.com/neo-hu/network-probe-tool/network/mtr"
 	"github.com/neo-hu/network-probe-tool/pkg/icmp"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"time"
 )
 
-type StringSet map[string]struct{}
-
-func (ms StringSet) Add(mk string) {
-	ms[mk] = struct{}{}
-}
-
-func (ms StringSet) String() string {
-	var values []string
-	for metric, _ := range ms {
-		values = append(values, string(metric))
-	}
-	return strings.Join(values, ",")
-}
-
 func main() {
 	var count = 3
 	var maxTTL = 30
 	var timeout = icmp.DefaultTimeout
 	var interval = icmp.DefaultInterval
 	var dataSize = icmp.DefaultDataSize
+	var unprivileged bool
+	var protocol = "icmp"
+	var port int
+	var paris bool
+	var confidence float64
+	var live bool
+	var nameserver string
+	var resolver string
+	var asn bool
+	var duration time.Duration
 	flag.IntVar(&maxTTL, "max-ttl", maxTTL, "Specifies the maximum number of hops (max time-to-live value) traceroute will probe")
 	flag.IntVar(&count, "c", count, "count of pings to send to each target")
 	flag.DurationVar(&timeout, "t", timeout, "individual target initial timeout")
 	flag.DurationVar(&interval, "i", interval, "interval between sending ping packets")
 	flag.IntVar(&dataSize, "d", dataSize, "amount of ping data to send, in bytes")
+	flag.BoolVar(&unprivileged, "u", unprivileged, "use unprivileged icmp datagram sockets, fall back to raw sockets")
+	flag.StringVar(&protocol, "P", protocol, "probe protocol: icmp, udp or tcp")
+	flag.IntVar(&port, "p", port, "destination port (udp base port, default 33434; tcp default 80)")
+	flag.BoolVar(&paris, "paris", paris, "keep the flow identifier constant across probes (Paris traceroute)")
+	flag.Float64Var(&confidence, "mda", confidence, "discover all load balanced paths with the given confidence, e.g. 0.95 (icmp or udp)")
+	flag.BoolVar(&live, "live", live, "keep running and print a report after every round, until interrupted")
+	flag.DurationVar(&duration, "duration", duration, "keep running for the given duration and print a report after every round")
+	flag.StringVar(&nameserver, "dns", nameserver, "resolve hop names (PTR) with the given nameserver, e.g. 8.8.8.8")
+	flag.StringVar(&resolver, "resolver", resolver, "resolve targets with the given nameserver instead of the system resolver")
+	flag.BoolVar(&asn, "asn", asn, "look up hop ASN through Team Cymru DNS (uses -dns, default 8.8.8.8)")
 	flag.Parse()
 	target := flag.Arg(0)
 	if target == "" {
-		fmt.Printf("Usage of %s www.ip8.me\n", os.Args[0])
+		fmt.Printf("Usage of %s www.ip8.me [more targets...]\n", os.Args[0])
 		flag.PrintDefaults()
 		return
 	}
-	m, err := mtr.NewMtr(target,
+	socketType := icmp.SocketRaw
+	if unprivileged {
+		socketType = icmp.SocketAuto
+	}
+	var proto mtr.Protocol
+	switch protocol {
+	case "icmp":
+		proto = mtr.ProtocolICMP
+	case "udp":
+		proto = mtr.ProtocolUDP
+	case "tcp":
+		proto = mtr.ProtocolTCP
+	default:
+		log.Fatalf("unknown protocol %q", protocol)
+	}
+	opts := []mtr.Option{
+		mtr.SocketTypeOption(socketType),
+		mtr.ProtocolOption(proto),
+		mtr.PortOption(port),
 		mtr.CountOption(count),
 		mtr.TimeoutOption(timeout),
 		mtr.DataSizeOption(uint32(dataSize)),
 		mtr.MaxTTLOption(maxTTL),
-		mtr.IntervalOption(interval))
+		mtr.IntervalOption(interval),
+	}
+	if paris {
+		opts = append(opts, mtr.ParisOption())
+	}
+	if resolver != "" {
+		opts = append(opts, mtr.ResolverOption(dns.NewDNS(resolver)))
+	}
+	if nameserver != "" {
+		opts = append(opts, mtr.ReverseDNSOption(dns.NewDNS(nameserver)))
+	}
+	if asn {
+		if nameserver == "" {
+			nameserver = "8.8.8.8"
+		}
+		opts = append(opts, mtr.ASNOption(mtr.NewCymruProvider(dns.NewDNS(nameserver))))
+	}
+	if confidence > 0 {
+		opts = append(opts, mtr.MultipathOption(confidence))
+	}
+	if live || duration > 0 {
+		if live {
+			opts = append(opts, mtr.ContinuousOption())
+		} else {
+			opts = append(opts, mtr.DurationOption(duration))
+		}
+		opts = append(opts, mtr.RoundHandlerOption(func(round int, result *mtr.Result) {
+			fmt.Printf("\nround %d ", round+1)
+			printResult(result)
+		}))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if flag.NArg() > 1 {
+		// 多个目标共享 socket
+		t := mtr.NewTracer(mtr.TracerTargetOption(opts...))
+		defer t.Close()
+		for _, target := range flag.Args() {
+			if err := t.Add(target); err != nil {
+				t.Close()
+				log.Fatal(err)
+			}
+		}
+		results, err := t.StartContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Fatal(err)
+		}
+		for _, result := range results {
+			fmt.Println()
+			printResult(result)
+		}
+		return
+	}
+	m, err := mtr.NewMtr(target, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	result, err := m.Start()
-	if err != nil {
+	defer m.Close()
+	result, err := m.StartContext(ctx)
+	if err != nil && ctx.Err() == nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("%s => %s\n", result.LocalIp, result.TargetIp)
-	fmt.Println("ttl", "host", "max", "min", "avg", "loss")
+	if live || duration > 0 {
+		fmt.Print("\nsummary ")
+	}
+	printResult(result)
+}
+
+func printResult(result *mtr.Result) {
+	fmt.Printf("%s => %s(%s)", result.LocalIp, result.Target, result.TargetIp)
+	if result.ResolveTime > 0 {
+		fmt.Printf(" resolved in %v", result.ResolveTime)
+	}
+	fmt.Println()
+	fmt.Println("ttl", "host", "loss%", "snt", "last", "avg", "best", "wrst", "stdev", "jttr")
 	for i, ttlResult := range result.TTL {
 		if len(ttlResult.Entries) <= 0 {
 			continue
 		}
-		ips := make(StringSet)
-		var (
-			sum   time.Duration
-			max   time.Duration
-			min   time.Duration
-			num   time.Duration
-			avg   time.Duration
-			reply float64
-		)
-		for _, entry := range ttlResult.Entries {
-			if len(entry.IP) != 0 {
-				reply += 1
-				ips.Add(entry.IP.String())
-				sum += entry.Elapsed
-				num += 1
-				if entry.Elapsed > max {
-					max = entry.Elapsed
-				}
-				if min == 0 || entry.Elapsed < min {
-					min = entry.Elapsed
-				}
+		var ips []string
+		for _, host := range ttlResult.Hosts {
+			name := host.IP.String()
+			if host.Name != "" {
+				name = fmt.Sprintf("%s(%s)", host.Name, host.IP)
 			}
-
+			if host.ASN != nil {
+				name = fmt.Sprintf("[AS%d]%s", host.ASN.Number, name)
+			}
+			if host.Unreachable != nil {
+				name += " " + host.Unreachable.String()
+			}
+			ips = append(ips, name)
 		}
-		if num > 0 {
-			avg = sum / num
+		if len(ips) == 0 {
+			ips = append(ips, "???")
 		}
-		fmt.Println(i+1, ips.String(), max, min, avg,
-			(float64(len(ttlResult.Entries))-reply)/float64(len(ttlResult.Entries))*100)
+		fmt.Printf("%d %s %.1f%% %d %s %s %s %s %s %s\n", i+1, strings.Join(ips, ","), ttlResult.Loss, ttlResult.Sent,
+			ttlResult.Last, ttlResult.Avg, ttlResult.Best, ttlResult.Worst, ttlResult.StdDev, ttlResult.Jitter)
+		for _, host := range ttlResult.Hosts {
+			for _, label := range host.MPLS {
+				fmt.Printf("   %s [MPLS: %s]\n", host.IP, label)
+			}
+			for _, info := range host.Interfaces {
+				fmt.Printf("   %s [IF: %s]\n", host.IP, info)
+			}
+		}
+		if ttlResult.SendErr != nil {
+			fmt.Printf("   send error: %v\n", ttlResult.SendErr)
+		}
+	}
+	if result.Graph != nil {
+		fmt.Println("nodes:")
+		for _, node := range result.Graph.Nodes {
+			fmt.Println(node.TTL, hostString(node.IP), "probes", node.Probes)
+		}
+		fmt.Println("links:")
+		for _, link := range result.Graph.Links {
+			fmt.Println(link.TTL, hostString(link.From), "->", hostString(link.To), "probes", link.Probes)
+		}
+	}
+}
+
+func hostString(ip net.IP) string {
+	if ip == nil {
+		return "*"
 	}
+	return ip.String()
 }
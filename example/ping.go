@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/neo-hu/network-probe-tool/network/dns"
 	"github.com/neo-hu/network-probe-tool/network/ping"
 	"github.com/neo-hu/network-probe-tool/pkg/icmp"
 	"log"
 	"os"
+	"os/signal"
+	"time"
 )
 
 func main() {
@@ -14,11 +18,23 @@ func main() {
 	var timeout = icmp.DefaultTimeout
 	var interval = icmp.DefaultInterval
 	var dataSize = icmp.DefaultDataSize
+	var unprivileged bool
+	var verbose bool
+	var report time.Duration
+	var ipv4, ipv6, all bool
+	var resolver string
 
 	flag.IntVar(&count, "c", count, "count of pings to send to each target")
 	flag.DurationVar(&timeout, "t", timeout, "individual target initial timeout")
 	flag.DurationVar(&interval, "i", interval, "interval between sending ping packets")
 	flag.IntVar(&dataSize, "d", dataSize, "amount of ping data to send, in bytes")
+	flag.BoolVar(&ipv4, "4", ipv4, "use IPv4 addresses only")
+	flag.BoolVar(&ipv6, "6", ipv6, "use IPv6 addresses only")
+	flag.BoolVar(&all, "a", all, "ping every resolved address of each target")
+	flag.DurationVar(&report, "r", report, "ping continuously and print rolling statistics at this interval, until interrupted")
+	flag.BoolVar(&verbose, "v", verbose, "print every send, reply and timeout as it happens")
+	flag.BoolVar(&unprivileged, "u", unprivileged, "use unprivileged icmp datagram sockets, fall back to raw sockets")
+	flag.StringVar(&resolver, "resolver", resolver, "resolve targets with the given nameserver instead of the system resolver")
 	flag.Parse()
 	if flag.NArg() == 0 {
 		fmt.Printf("Usage of %s www.ip8.me\n", os.Args[0])
@@ -26,22 +42,76 @@ func main() {
 		return
 	}
 
-	p := ping.NewPing(ping.IntervalOption(interval))
+	socketType := icmp.SocketRaw
+	if unprivileged {
+		socketType = icmp.SocketAuto
+	}
+	// 无法解析的目标记录在结果中, 不影响其它目标
+	opts := []ping.Option{ping.IntervalOption(interval), ping.SocketTypeOption(socketType), ping.TolerantOption()}
+	if resolver != "" {
+		opts = append(opts, ping.ResolverOption(dns.NewDNS(resolver)))
+	}
+	if verbose {
+		opts = append(opts, ping.EventHandlerOption(func(ev ping.Event) {
+			fmt.Println(ev.String())
+		}))
+	}
+	p := ping.NewPing(opts...)
+	defer p.Close()
+	addrOpts := []ping.AddressOption{
+		ping.CountOpt(count),
+		ping.TimeoutOption(timeout),
+		ping.DataSizeOption(dataSize),
+		ping.AddressIntervalOption(interval),
+	}
+	if report > 0 {
+		addrOpts = append(addrOpts, ping.ContinuousOpt())
+	}
+	if ipv4 {
+		addrOpts = append(addrOpts, ping.ForceIPv4Opt())
+	} else if ipv6 {
+		addrOpts = append(addrOpts, ping.ForceIPv6Opt())
+	}
+	if all {
+		addrOpts = append(addrOpts, ping.AllAddressesOpt())
+	}
 	for _, host := range flag.Args() {
-		err := p.Add(host,
-			ping.CountOpt(count),
-			ping.TimeoutOption(timeout),
-			ping.DataSizeOption(dataSize),
-			ping.AddressIntervalOption(interval))
+		err := p.Add(host, addrOpts...)
 		if err != nil {
+			// log.Fatal 不会执行 defer
+			p.Close()
 			log.Fatal(err)
 		}
 	}
-	rs, err := p.Start()
-	if err != nil {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if report > 0 {
+		go func() {
+			ticker := time.NewTicker(report)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				for _, r := range p.Snapshot() {
+					fmt.Printf("[%s(%s)]\n", r.Host, r.IP)
+					for _, w := range r.Windows {
+						fmt.Println("  " + w.String())
+					}
+				}
+			}
+		}()
+	}
+	rs, err := p.StartContext(ctx)
+	if err != nil && err != context.Canceled {
 		log.Fatal(err)
 	}
 	for _, r := range rs {
+		if r.ResolveTime > 0 {
+			fmt.Printf("[%s] resolved in %v\n", r.Host, r.ResolveTime)
+		}
 		fmt.Println(r.String())
 	}
 }
@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Nameserver 参与比较的服务器, Name 是 NS 记录中的主机名, 手动指定的时候为空
+type Nameserver struct {
+	Name string
+	Addr string // 和 NewDNS 的 nameserver 相同, ip, ip:port 或者 DoH 的 url
+	Err  error  // 自动发现的时候解析 Name 的地址失败
+}
+
+func (n Nameserver) String() string {
+	if n.Name == "" {
+		return n.Addr
+	}
+	if n.Addr == "" {
+		return n.Name
+	}
+	return fmt.Sprintf("%s(%s)", n.Name, n.Addr)
+}
+
+// Nameservers 手动指定的服务器
+func Nameservers(addrs ...string) []Nameserver {
+	nameservers := make([]Nameserver, 0, len(addrs))
+	for _, addr := range addrs {
+		nameservers = append(nameservers, Nameserver{Addr: addr})
+	}
+	return nameservers
+}
+
+// DiscoverNameservers 通过 d 查询 zone 的 NS 记录, 每个 NS 的每个地址是一个 Nameserver,
+// 优先使用 additional 中的 glue, 没有的时候通过 d 查询 A 和 AAAA, 查询失败的 NS 的 Err 不为空
+func (d *DNS) DiscoverNameservers(ctx context.Context, zone string) ([]Nameserver, error) {
+	r, err := d.QueryContext(ctx, zone, TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, &RcodeError{Rcode: r.Rcode, Response: r}
+	}
+	glue := map[string][]string{}
+	for _, record := range r.Additional() {
+		switch rr := record.RR.(type) {
+		case *dns.A:
+			glue[dns.CanonicalName(rr.Hdr.Name)] = append(glue[dns.CanonicalName(rr.Hdr.Name)], rr.A.String())
+		case *dns.AAAA:
+			glue[dns.CanonicalName(rr.Hdr.Name)] = append(glue[dns.CanonicalName(rr.Hdr.Name)], rr.AAAA.String())
+		}
+	}
+	var nameservers []Nameserver
+	for _, name := range r.Strings(TypeNS) {
+		addrs := glue[dns.CanonicalName(name)]
+		if len(addrs) == 0 {
+			ips, err := d.LookupIPAddr(ctx, name)
+			if err != nil {
+				nameservers = append(nameservers, Nameserver{Name: name, Err: err})
+				continue
+			}
+			for _, ip := range ips {
+				addrs = append(addrs, ip.IP.String())
+			}
+		}
+		for _, addr := range addrs {
+			nameservers = append(nameservers, Nameserver{Name: name, Addr: addr})
+		}
+	}
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("no NS records for %s", zone)
+	}
+	return nameservers, nil
+}
+
+// ServerResult 一个服务器的结果
+type ServerResult struct {
+	Nameserver Nameserver
+	Response   *Response
+	Err        error    // 传输的错误, 包括被截断
+	Answer     []string // answer 中的记录排序之后的结果, 不包括 TTL
+	Serial     uint32   // 区的 SOA serial, 没有查询到的时候为 0
+}
+
+// AnswerGroup 返回相同结果的服务器
+type AnswerGroup struct {
+	Rcode       int
+	Answer      []string
+	Nameservers []Nameserver
+}
+
+type Report struct {
+	Name    string
+	Type    uint16
+	Results []*ServerResult // 和 nameservers 的顺序相同
+	Answers []AnswerGroup   // 成功的服务器按结果分组, 服务器多的在前
+	Serials map[uint32][]Nameserver
+	Failed  []*ServerResult
+}
+
+// AnswerMismatch 成功的服务器返回了不同的 rcode 或者记录
+func (r *Report) AnswerMismatch() bool {
+	return len(r.Answers) > 1
+}
+
+// SerialMismatch 服务器的 SOA serial 不同, 通常是区传送还没有完成
+func (r *Report) SerialMismatch() bool {
+	return len(r.Serials) > 1
+}
+
+// Consistent 所有服务器都成功, 结果和 serial 都相同
+func (r *Report) Consistent() bool {
+	return len(r.Failed) == 0 && !r.AnswerMismatch() && !r.SerialMismatch()
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s consistent=%v\n", r.Name, dns.TypeToString[r.Type], r.Consistent())
+	for _, result := range r.Results {
+		if result.Err != nil {
+			fmt.Fprintf(&b, "  %-40s error: %v\n", result.Nameserver, result.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "  %-40s %s rtt=%v serial=%d %v\n", result.Nameserver, result.Response.RcodeString(),
+			result.Response.RTT, result.Serial, result.Answer)
+	}
+	if r.AnswerMismatch() {
+		fmt.Fprintf(&b, "answer mismatch:\n")
+		for _, group := range r.Answers {
+			fmt.Fprintf(&b, "  %s %v: %v\n", dns.RcodeToString[group.Rcode], group.Answer, group.Nameservers)
+		}
+	}
+	if r.SerialMismatch() {
+		fmt.Fprintf(&b, "serial mismatch:\n")
+		serials := make([]uint32, 0, len(r.Serials))
+		for serial := range r.Serials {
+			serials = append(serials, serial)
+		}
+		sort.Slice(serials, func(i, j int) bool { return serials[i] > serials[j] })
+		for _, serial := range serials {
+			fmt.Fprintf(&b, "  %d: %v\n", serial, r.Serials[serial])
+		}
+	}
+	return b.String()
+}
+
+// Compare 并发的向每个服务器查询 addr 的 t 类型的记录和 addr 所在区的 SOA, opts 用于每个服务器的 DNS
+func Compare(ctx context.Context, nameservers []Nameserver, addr string, t uint16, opts ...Option) *Report {
+	report := &Report{Name: dns.Fqdn(addr), Type: t, Serials: map[uint32][]Nameserver{}}
+	var wg sync.WaitGroup
+	for _, ns := range nameservers {
+		result := &ServerResult{Nameserver: ns}
+		report.Results = append(report.Results, result)
+		if ns.Err != nil {
+			result.Err = ns.Err
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.query(ctx, NewDNS(result.Nameserver.Addr, opts...), addr, t)
+		}()
+	}
+	wg.Wait()
+	groups := map[string]int{}
+	for _, result := range report.Results {
+		if result.Err != nil {
+			report.Failed = append(report.Failed, result)
+			continue
+		}
+		key := fmt.Sprintf("%d %s", result.Response.Rcode, strings.Join(result.Answer, "\n"))
+		i, ok := groups[key]
+		if !ok {
+			i = len(report.Answers)
+			groups[key] = i
+			report.Answers = append(report.Answers, AnswerGroup{Rcode: result.Response.Rcode, Answer: result.Answer})
+		}
+		report.Answers[i].Nameservers = append(report.Answers[i].Nameservers, result.Nameserver)
+		if result.Serial != 0 {
+			report.Serials[result.Serial] = append(report.Serials[result.Serial], result.Nameserver)
+		}
+	}
+	sort.SliceStable(report.Answers, func(i, j int) bool {
+		return len(report.Answers[i].Nameservers) > len(report.Answers[j].Nameservers)
+	})
+	return report
+}
+
+// query SOA 查询 addr 本身, 区的顶点在 answer 中, 其它的名字在 authority 中
+func (s *ServerResult) query(ctx context.Context, d *DNS, addr string, t uint16) {
+	s.Response, s.Err = d.QueryContext(ctx, addr, t)
+	if s.Err != nil {
+		return
+	}
+	for _, record := range s.Response.Answer() {
+		s.Answer = append(s.Answer, fmt.Sprintf("%s %s %s", dns.CanonicalName(record.Name), dns.TypeToString[record.Type], record.Data))
+	}
+	sort.Strings(s.Answer)
+	soa := s.Response
+	if t != TypeSOA {
+		if soa, _ = d.QueryContext(ctx, addr, TypeSOA); soa == nil {
+			return
+		}
+	}
+	for _, record := range soa.Records {
+		if rr, ok := record.RR.(*dns.SOA); ok && record.Section != SectionAdditional {
+			s.Serial = rr.Serial
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cmpZone cmp.lab. 的权威服务器, 记录收到的查询
+type cmpZone struct {
+	serial uint32
+	www    string // www.cmp.lab. 的 A 记录
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (z *cmpZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	z.mu.Lock()
+	z.queries = append(z.queries, fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype]))
+	z.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	soa, _ := dns.NewRR(fmt.Sprintf("cmp.lab. 300 IN SOA ns1.cmp.lab. h.cmp.lab. %d 3600 600 86400 300", z.serial))
+	add := func(rrs *[]dns.RR, s string) {
+		rr, _ := dns.NewRR(s)
+		*rrs = append(*rrs, rr)
+	}
+	switch {
+	case q.Name == "cmp.lab." && q.Qtype == dns.TypeNS:
+		// ns1 有 glue, ns2 需要再查询, ns3 不存在
+		add(&m.Answer, "cmp.lab. 300 IN NS ns1.cmp.lab.")
+		add(&m.Answer, "cmp.lab. 300 IN NS ns2.cmp.lab.")
+		add(&m.Answer, "cmp.lab. 300 IN NS ns3.cmp.lab.")
+		add(&m.Extra, "ns1.cmp.lab. 300 IN A 127.0.0.11")
+		add(&m.Extra, "NS1.cmp.lab. 300 IN AAAA ::11")
+	case q.Name == "ns1.cmp.lab." && q.Qtype == dns.TypeA:
+		add(&m.Answer, "ns1.cmp.lab. 300 IN A 192.0.2.1")
+	case q.Name == "ns2.cmp.lab." && q.Qtype == dns.TypeA:
+		add(&m.Answer, "ns2.cmp.lab. 300 IN A 127.0.0.12")
+	case q.Name == "ns2.cmp.lab." && q.Qtype == dns.TypeAAAA, q.Name == "ns1.cmp.lab.":
+		m.Ns = append(m.Ns, soa)
+	case q.Name == "cmp.lab." && q.Qtype == dns.TypeSOA:
+		m.Answer = append(m.Answer, soa)
+	case q.Name == "www.cmp.lab." && q.Qtype == dns.TypeA:
+		add(&m.Answer, "www.cmp.lab. 300 IN A "+z.www)
+		add(&m.Answer, "www.cmp.lab. 60 IN A 10.0.0.2")
+	case q.Name == "www.cmp.lab.":
+		m.Ns = append(m.Ns, soa)
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, soa)
+	}
+	w.WriteMsg(m)
+}
+
+// deadAddr 没有服务器的 udp 端口
+func deadAddr(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func TestCompare(t *testing.T) {
+	a := startServer(t, &cmpZone{serial: 2, www: "10.0.0.1"})
+	b := startServer(t, &cmpZone{serial: 2, www: "10.0.0.1"})
+	// serial 旧, 记录也不同
+	c := startServer(t, &cmpZone{serial: 1, www: "10.0.0.9"})
+	dead := deadAddr(t)
+	ctx := context.Background()
+	opts := []Option{TimeoutOption(500 * time.Millisecond)}
+
+	t.Run("consistent", func(t *testing.T) {
+		report := Compare(ctx, Nameservers(a, b), "www.cmp.lab", TypeA, opts...)
+		if !report.Consistent() || report.AnswerMismatch() || report.SerialMismatch() || len(report.Failed) != 0 {
+			t.Fatalf("report:\n%s", report)
+		}
+		want := []string{"www.cmp.lab. A 10.0.0.1", "www.cmp.lab. A 10.0.0.2"}
+		for _, result := range report.Results {
+			if !reflect.DeepEqual(result.Answer, want) || result.Serial != 2 {
+				t.Fatalf("%s: answer = %v, serial = %d", result.Nameserver, result.Answer, result.Serial)
+			}
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		report := Compare(ctx, Nameservers(c, a, dead, b), "www.cmp.lab", TypeA, opts...)
+		if report.Consistent() || !report.AnswerMismatch() || !report.SerialMismatch() {
+			t.Fatalf("report:\n%s", report)
+		}
+		if len(report.Results) != 4 || report.Results[2].Nameserver.Addr != dead {
+			t.Fatalf("results are not in the order of nameservers:\n%s", report)
+		}
+		if len(report.Answers) != 2 ||
+			!reflect.DeepEqual(report.Answers[0].Nameservers, Nameservers(a, b)) ||
+			!reflect.DeepEqual(report.Answers[1].Nameservers, Nameservers(c)) ||
+			report.Answers[1].Answer[0] != "www.cmp.lab. A 10.0.0.2" || report.Answers[1].Answer[1] != "www.cmp.lab. A 10.0.0.9" {
+			t.Fatalf("answers = %+v", report.Answers)
+		}
+		if want := map[uint32][]Nameserver{1: Nameservers(c), 2: Nameservers(a, b)}; !reflect.DeepEqual(report.Serials, want) {
+			t.Fatalf("serials = %v, want %v", report.Serials, want)
+		}
+		if len(report.Failed) != 1 || report.Failed[0].Nameserver.Addr != dead || errorKind(report.Failed[0].Err) != ErrorRefused {
+			t.Fatalf("failed = %+v", report.Failed)
+		}
+	})
+
+	t.Run("soa", func(t *testing.T) {
+		report := Compare(ctx, Nameservers(a, c), "cmp.lab", TypeSOA, opts...)
+		if !report.AnswerMismatch() || !report.SerialMismatch() || report.Results[0].Serial != 2 || report.Results[1].Serial != 1 {
+			t.Fatalf("report:\n%s", report)
+		}
+	})
+
+	t.Run("nameserver error", func(t *testing.T) {
+		errNS := fmt.Errorf("no such host")
+		report := Compare(ctx, []Nameserver{{Addr: a}, {Name: "ns3.cmp.lab.", Err: errNS}}, "www.cmp.lab", TypeA, opts...)
+		if len(report.Failed) != 1 || report.Failed[0].Err != errNS || report.AnswerMismatch() || report.Consistent() {
+			t.Fatalf("report:\n%s", report)
+		}
+	})
+}
+
+func TestDiscoverNameservers(t *testing.T) {
+	z := &cmpZone{serial: 1, www: "10.0.0.1"}
+	d := NewDNS(startServer(t, z))
+	nameservers, err := d.DiscoverNameservers(context.Background(), "cmp.lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nameservers) != 4 {
+		t.Fatalf("nameservers = %v", nameservers)
+	}
+	// glue 的名字不区分大小写, 不再查询 ns1 的地址
+	want := []Nameserver{
+		{Name: "ns1.cmp.lab.", Addr: "127.0.0.11"},
+		{Name: "ns1.cmp.lab.", Addr: "::11"},
+		{Name: "ns2.cmp.lab.", Addr: "127.0.0.12"},
+	}
+	if !reflect.DeepEqual(nameservers[:3], want) {
+		t.Fatalf("nameservers = %v, want %v", nameservers[:3], want)
+	}
+	if ns := nameservers[3]; ns.Name != "ns3.cmp.lab." || ns.Addr != "" || ns.Err == nil {
+		t.Fatalf("ns3 = %+v, want error", ns)
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, q := range z.queries {
+		if q == "ns1.cmp.lab. A" || q == "ns1.cmp.lab. AAAA" {
+			t.Fatalf("queried %s, want glue", q)
+		}
+	}
+	if _, err := d.DiscoverNameservers(context.Background(), "nx.lab"); err == nil {
+		t.Fatal("DiscoverNameservers(nx.lab) error = nil")
+	}
+}
@@ -1,18 +1,29 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/miekg/dns"
 	"net"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	TypeA uint16 = dns.TypeA
+	TypeAAAA uint16 = dns.TypeAAAA
 	TypeANY uint16 = dns.TypeANY
 	TypeTXT uint16 = dns.TypeTXT
 	TypeCNAME uint16 = dns.TypeCNAME
 	TypeMX uint16 = dns.TypeMX
+	TypePTR uint16 = dns.TypePTR
+	TypeNS uint16 = dns.TypeNS
+	TypeSOA uint16 = dns.TypeSOA
+	TypeSRV uint16 = dns.TypeSRV
+	TypeCAA uint16 = dns.TypeCAA
 )
 
 type DNS struct {
@@ -20,10 +31,21 @@ type DNS struct {
 	network          string
 	timeout          time.Duration
 	recursionDesired bool
+
+	udpSize  uint16    // EDNS0 的缓冲区大小, 0 表示不发送 OPT
+	dnssecOK bool      // DO
+	anchors  []*dns.DS // 不为空的时候验证 DNSSEC
+
+	tlsConfig *tls.Config
+	pins      []string
+	method    string // DoH 的请求方法
+
+	tcpFallback bool
 }
 
 type Option func(*DNS)
 
+// NetworkOption udp, tcp 或者 tcp-tls (和 TLSOption(nil) 相同), DoH 不需要设置, 由 nameserver 的 url 决定
 func NetworkOption(network string) Option {
 	return func(m *DNS) {
 		m.network = network
@@ -49,46 +71,218 @@ func NewDNS(nameserver string,opts ...Option) *DNS {
 	return d
 }
 
+// EDNS0Option 发送 EDNS0 的 OPT 记录, size 是 udp 缓冲区的大小, 例如 DefaultEDNS0Size
+func EDNS0Option(size uint16) Option {
+	return func(m *DNS) {
+		m.udpSize = size
+	}
+}
+
+// DNSSECOption 设置 DO, 要求服务器返回 RRSIG 等 DNSSEC 记录, 没有 EDNS0Option 的时候缓冲区大小是 DefaultEDNS0Size
+func DNSSECOption() Option {
+	return func(m *DNS) {
+		m.dnssecOK = true
+	}
+}
+
+// TCPFallbackOption udp 的响应被截断 (TC) 的时候通过 tcp 重新查询, 结果是 tcp 的响应, 被截断的 udp 响应在 Response.TruncatedUDP.
+// tcp 查询失败的时候返回 udp 的响应和 ErrorTruncated, 包含 tcp 的错误, 例如 ErrorRefused
+func TCPFallbackOption() Option {
+	return func(m *DNS) {
+		m.tcpFallback = true
+	}
+}
+
 func (d *DNS) Exchange(addr string, t uint16) (time.Duration, []string, error) {
+	return d.ExchangeContext(context.Background(), addr, t)
+}
 
-	c := &dns.Client{
-		Net:     d.network,
-		Timeout: d.timeout,
+// ExchangeContext ctx 取消的时候会关闭连接, 立即返回 ctx.Err(),
+// 响应不是 NOERROR 的时候返回 rtt 和 *RcodeError, 被截断的时候返回 rtt, 已经收到的记录和 *Error
+func (d *DNS) ExchangeContext(ctx context.Context, addr string, t uint16) (time.Duration, []string, error) {
+	r, err := d.QueryContext(ctx, addr, t)
+	if r == nil {
+		return 0, nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return r.RTT, nil, &RcodeError{Rcode: r.Rcode, Response: r}
 	}
+	return r.RTT, r.Strings(t), err
+}
+
+func (d *DNS) Query(addr string, t uint16) (*Response, error) {
+	return d.QueryContext(context.Background(), addr, t)
+}
+
+// QueryContext 返回完整的响应, 包括 authority 和 additional, 任何 rcode 都不是错误,
+// 错误只有传输的错误 *Error 和 ctx.Err(), 被截断的时候同时返回 Response 和 ErrorTruncated
+func (d *DNS) QueryContext(ctx context.Context, addr string, t uint16) (*Response, error) {
+	r, err := d.exchange(ctx, d.newMsg(addr, t))
+	if r != nil && err == nil && d.anchors != nil {
+		r.Validation = d.validate(ctx, r.Msg)
+	}
+	return r, err
+}
+
+func (d *DNS) newMsg(addr string, t uint16) *dns.Msg {
 	m := new(dns.Msg)
 	m.Compress = true
 	m.SetQuestion(dns.Fqdn(addr), t)
+	if d.udpSize > 0 || d.dnssecOK {
+		size := d.udpSize
+		if size == 0 {
+			size = DefaultEDNS0Size
+		}
+		m.SetEdns0(size, d.dnssecOK)
+	}
+	if d.anchors != nil {
+		// 自己验证, 服务器验证失败的时候也要返回记录, 才能找到失败的环节
+		m.CheckingDisabled = true
+	}
+	return m
+}
+
+func (d *DNS) exchange(ctx context.Context, m *dns.Msg) (*Response, error) {
+	if d.isHTTPS() {
+		return d.exchangeHTTPS(ctx, m)
+	}
+	r, err := d.exchangeNetwork(ctx, m, d.network)
+	if r == nil || !r.Flags.Truncated || !d.tcpFallback || !strings.HasPrefix(d.network, "udp") {
+		return r, err
+	}
+	// udp4 使用 tcp4, udp6 使用 tcp6
+	tr, terr := d.exchangeNetwork(ctx, m, "tcp"+strings.TrimPrefix(d.network, "udp"))
+	if tr == nil {
+		return r, &Error{Kind: ErrorTruncated, Err: fmt.Errorf("tcp fallback: %w", terr)}
+	}
+	// tcp 的响应也被截断的时候, 返回 tcp 的响应和 ErrorTruncated
+	tr.TruncatedUDP = r
+	return tr, terr
+}
+
+func (d *DNS) exchangeNetwork(ctx context.Context, m *dns.Msg, network string) (*Response, error) {
+	c := &dns.Client{
+		Net:     network,
+		Timeout: d.timeout,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout := time.Until(deadline); timeout < c.Timeout {
+			c.Timeout = timeout
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	nameserver := d.nameserver
-	if net.ParseIP(nameserver) != nil {
-		nameserver = net.JoinHostPort(nameserver, "53")
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		port := "53"
+		if network == "tcp-tls" {
+			port = "853"
+		}
+		nameserver = net.JoinHostPort(nameserver, port)
+	}
+	var co *dns.Conn
+	var state *tls.ConnectionState
+	var timing Timing
+	var err error
+	start := time.Now()
+	if network == "tcp-tls" {
+		co, state, err = d.dialTLS(ctx, nameserver, c.Timeout, &timing)
+	} else if co, err = c.Dial(nameserver); err != nil {
+		err = transportErr(ctx, err)
 	}
-	r, rtt, err := c.Exchange(m, nameserver)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-	if r.Rcode != dns.RcodeSuccess {
-		return 0, nil, fmt.Errorf("failed to get an valid answer %v %s", r.Rcode, dns.RcodeToString[r.Rcode])
-	}
-	var result []string
-	for _, k := range r.Answer {
-		switch t1 := k.(type) {
-		case *dns.A:
-			if t == TypeA || t == TypeANY  {
-				result = append(result, t1.A.String())
-			}
-		case *dns.TXT:
-			if t == TypeTXT || t == TypeANY  {
-				result = append(result, t1.Txt...)
-			}
-		case *dns.MX:
-			if t == TypeMX || t == TypeANY  {
-				result = append(result, t1.Mx)
-			}
-		case *dns.CNAME:
-			if t == TypeCNAME || t == TypeANY  {
-				result = append(result, t1.Target)
-			}
+	if network != "tcp-tls" {
+		timing.Connection = time.Since(start)
+	}
+	defer co.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			co.Close()
+		case <-done:
+		}
+	}()
+	r, err := roundTrip(co, m, c.Timeout, &timing)
+	if err != nil {
+		return nil, transportErr(ctx, err)
+	}
+	timing.Total = time.Since(start)
+	response := newResponse(r, timing.QueryWrite+timing.ServerProcessing+timing.ContentTransfer)
+	response.TLS, response.Timing = state, timing
+	if r.Truncated {
+		return response, &Error{Kind: ErrorTruncated, Err: errors.New("truncated response")}
+	}
+	return response, nil
+}
+
+// roundTrip 和 dns.Client.ExchangeWithConn 相同, 另外记录写入, 第一个字节和读取的耗时
+func roundTrip(co *dns.Conn, m *dns.Msg, timeout time.Duration, timing *Timing) (*dns.Msg, error) {
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	_, udp := co.Conn.(net.PacketConn)
+	fc := &firstByteConn{Conn: co.Conn}
+	if !udp {
+		co.Conn = fc
+	}
+	start := time.Now()
+	co.SetWriteDeadline(start.Add(timeout))
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	written := time.Now()
+	timing.QueryWrite = written.Sub(start)
+	co.SetReadDeadline(written.Add(timeout))
+	var r *dns.Msg
+	var err error
+	for {
+		r, err = co.ReadMsg()
+		// udp 忽略 id 不同的响应, 可能是之前超时的查询的响应
+		if err != nil || r.Id == m.Id {
+			break
+		}
+		if !udp {
+			err = dns.ErrId
+			break
 		}
 	}
-	return rtt, result, nil
+	if err != nil {
+		return nil, err
+	}
+	done := time.Now()
+	first := done
+	if !udp && !fc.first.IsZero() {
+		first = fc.first
+	}
+	timing.ServerProcessing = first.Sub(written)
+	timing.ContentTransfer = done.Sub(first)
+	return r, nil
+}
+
+// ReverseAddr 返回 ip 的 PTR 查询地址, 例如 1.0.0.127.in-addr.arpa.
+func ReverseAddr(ip net.IP) (string, error) {
+	return dns.ReverseAddr(ip.String())
+}
+
+// transportErr 连接的超时时间来自 ctx 的时候, 返回 ctx 的错误, 其它的错误转换成 *Error
+func transportErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	kind := ErrorNetwork
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		kind = ErrorTimeout
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		kind = ErrorRefused
+	}
+	return &Error{Kind: kind, Err: err}
 }
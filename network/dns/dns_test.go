@@ -0,0 +1,226 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startUDPTCP 在 127.0.0.1 的同一个端口启动 udp 和 tcp 服务器, 返回地址和关闭 tcp 服务器的函数
+func startUDPTCP(t *testing.T, handler dns.Handler) (string, func()) {
+	t.Helper()
+	addr := startServer(t, handler)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	shutdown := func() { server.Shutdown() }
+	t.Cleanup(shutdown)
+	return addr, shutdown
+}
+
+// truncateHandler udp 只返回 1 条记录并且设置 TC, tcp 返回 n 条记录, tcpTruncated 的时候 tcp 也设置 TC
+type truncateHandler struct {
+	n            int
+	tcpTruncated bool
+}
+
+func (h *truncateHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	q := req.Question[0]
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	n := h.n
+	if udp {
+		n = 1
+	}
+	for i := 1; i <= n; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 300 IN A 192.0.2.%d", q.Name, i))
+		m.Answer = append(m.Answer, rr)
+	}
+	m.Truncated = udp || h.tcpTruncated
+	w.WriteMsg(m)
+}
+
+func TestTCPFallback(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		addr, _ := startUDPTCP(t, &truncateHandler{n: 3})
+		r, err := NewDNS(addr, TCPFallbackOption()).Query("big.example", TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Strings(TypeA); len(got) != 3 || r.Flags.Truncated {
+			t.Fatalf("answer = %v, truncated = %v, want 3 records from tcp", got, r.Flags.Truncated)
+		}
+		if r.TruncatedUDP == nil || !r.TruncatedUDP.Flags.Truncated || len(r.TruncatedUDP.Strings(TypeA)) != 1 {
+			t.Fatalf("TruncatedUDP = %+v", r.TruncatedUDP)
+		}
+		if r.Timing.Connection <= 0 || r.TruncatedUDP.Timing.Total <= 0 {
+			t.Fatalf("Timing = %+v, udp Timing = %+v", r.Timing, r.TruncatedUDP.Timing)
+		}
+	})
+
+	t.Run("tcp closed", func(t *testing.T) {
+		addr, shutdown := startUDPTCP(t, &truncateHandler{n: 3})
+		shutdown()
+		r, err := NewDNS(addr, TCPFallbackOption()).Query("big.example", TypeA)
+		if errorKind(err) != ErrorTruncated || !strings.Contains(err.Error(), "tcp fallback") {
+			t.Fatalf("err = %v, want ErrorTruncated", err)
+		}
+		// tcp 的错误
+		var e *Error
+		if !errors.As(errors.Unwrap(err), &e) || e.Kind != ErrorRefused {
+			t.Fatalf("tcp err = %v, want ErrorRefused", errors.Unwrap(err))
+		}
+		if r == nil || !r.Flags.Truncated || len(r.Strings(TypeA)) != 1 || r.TruncatedUDP != nil {
+			t.Fatalf("response = %+v, want the truncated udp response", r)
+		}
+	})
+
+	t.Run("tcp truncated", func(t *testing.T) {
+		addr, _ := startUDPTCP(t, &truncateHandler{n: 2, tcpTruncated: true})
+		r, err := NewDNS(addr, TCPFallbackOption()).Query("big.example", TypeA)
+		if errorKind(err) != ErrorTruncated {
+			t.Fatalf("err = %v, want ErrorTruncated", err)
+		}
+		if r == nil || len(r.Strings(TypeA)) != 2 || r.TruncatedUDP == nil || len(r.TruncatedUDP.Strings(TypeA)) != 1 {
+			t.Fatalf("response = %+v, want the truncated tcp response", r)
+		}
+	})
+
+	t.Run("no fallback", func(t *testing.T) {
+		addr, _ := startUDPTCP(t, &truncateHandler{n: 3})
+		r, err := NewDNS(addr).Query("big.example", TypeA)
+		if errorKind(err) != ErrorTruncated {
+			t.Fatalf("err = %v, want ErrorTruncated", err)
+		}
+		if r == nil || len(r.Strings(TypeA)) != 1 || r.TruncatedUDP != nil {
+			t.Fatalf("response = %+v, want the truncated udp response", r)
+		}
+	})
+}
+
+// silentAddr 收到查询不回复的 udp 端口
+func silentAddr(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func rcodeHandler(rcode int) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		w.WriteMsg(m)
+	})
+}
+
+func TestExchangeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		timeout time.Duration // ctx 的超时, 0 表示没有
+		kind    ErrorKind     // *Error 的类型
+		target  error         // errors.Is
+		rcode   int           // *RcodeError 的 rcode
+		answer  int           // ExchangeContext 返回的记录数量
+	}{
+		{"timeout", silentAddr(t), 0, ErrorTimeout, nil, 0, 0},
+		{"ctx deadline", silentAddr(t), 50 * time.Millisecond, 0, context.DeadlineExceeded, 0, 0},
+		{"refused", deadAddr(t), 0, ErrorRefused, syscall.ECONNREFUSED, 0, 0},
+		// 之前被截断的响应返回 nil 的错误
+		{"truncated", startServer(t, &truncateHandler{n: 3}), 0, ErrorTruncated, nil, 0, 1},
+		{"servfail", startServer(t, rcodeHandler(dns.RcodeServerFailure)), 0, 0, nil, dns.RcodeServerFailure, 0},
+		{"nxdomain", startServer(t, rcodeHandler(dns.RcodeNameError)), 0, 0, nil, dns.RcodeNameError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			d := NewDNS(tt.addr, TimeoutOption(200*time.Millisecond))
+			_, answer, err := d.ExchangeContext(ctx, "www.example.com", TypeA)
+			if err == nil {
+				t.Fatal("err = nil")
+			}
+			if len(answer) != tt.answer {
+				t.Fatalf("answer = %v, want %d records", answer, tt.answer)
+			}
+			var e *Error
+			if errors.As(err, &e) != (tt.kind != 0) || tt.kind != 0 && e.Kind != tt.kind {
+				t.Fatalf("err = %v, want kind %v", err, tt.kind)
+			}
+			if tt.kind == ErrorTimeout {
+				var ne net.Error
+				if !errors.As(err, &ne) || !ne.Timeout() {
+					t.Fatalf("err = %v, want net.Error timeout", err)
+				}
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Fatalf("err = %v, want %v", err, tt.target)
+			}
+			var re *RcodeError
+			if errors.As(err, &re) != (tt.rcode != 0) || tt.rcode != 0 && (re.Rcode != tt.rcode || re.Response.Rcode != tt.rcode) {
+				t.Fatalf("err = %v, want rcode %d", err, tt.rcode)
+			}
+			// Query 的 rcode 不是错误
+			if tt.rcode != 0 {
+				r, err := d.QueryContext(ctx, "www.example.com", TypeA)
+				if err != nil || r.Rcode != tt.rcode {
+					t.Fatalf("Query rcode = %v, err = %v", r, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTiming(t *testing.T) {
+	const delay = 5 * time.Millisecond
+	addr, _ := startUDPTCP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(delay)
+		answerHandler.ServeDNS(w, req)
+	}))
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			r, err := NewDNS(addr, NetworkOption(network)).Query("www.example.com", TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tm := r.Timing
+			if tm.Connection <= 0 || tm.QueryWrite <= 0 || tm.ServerProcessing <= 0 || tm.Total <= 0 {
+				t.Fatalf("Timing = %+v, want non-zero phases", tm)
+			}
+			if tm.ServerProcessing < delay {
+				t.Fatalf("ServerProcessing = %s, want >= %s", tm.ServerProcessing, delay)
+			}
+			if network == "udp" && tm.ContentTransfer != 0 {
+				t.Fatalf("udp ContentTransfer = %s, want 0", tm.ContentTransfer)
+			}
+			if tm.TLSHandshake != 0 || r.TLS != nil {
+				t.Fatalf("TLSHandshake = %s, want 0", tm.TLSHandshake)
+			}
+			if sum := tm.Connection + tm.QueryWrite + tm.ServerProcessing + tm.ContentTransfer; sum > tm.Total {
+				t.Fatalf("phases = %s, want <= Total %s", sum, tm.Total)
+			}
+			if rtt := tm.QueryWrite + tm.ServerProcessing + tm.ContentTransfer; r.RTT != rtt {
+				t.Fatalf("RTT = %s, want %s", r.RTT, rtt)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// DefaultEDNS0Size 避免 ip 分片的 udp 缓冲区大小, 参考 DNS Flag Day 2020
+const DefaultEDNS0Size = 1232
+
+// DS trust anchor, 和 miekg/dns 的 DS 是同一个类型
+type DS = dns.DS
+
+// RootTrustAnchors 根区的 KSK, 20326 是 KSK-2017, 38696 是 KSK-2024
+var RootTrustAnchors = []*DS{
+	mustTrustAnchor(". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"),
+	mustTrustAnchor(". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"),
+}
+
+// ValidateOption 从 anchors 开始验证信任链, 结果在 Response.Validation, 没有 anchors 的时候使用 RootTrustAnchors,
+// anchors 可以是任意一个区的 DS, 例如只信任自己的区. 会设置 DO 和 CD, 每次查询都会向 nameserver 查询信任链上的 DS 和 DNSKEY
+func ValidateOption(anchors ...*DS) Option {
+	return func(m *DNS) {
+		if len(anchors) == 0 {
+			anchors = RootTrustAnchors
+		}
+		m.anchors = anchors
+		m.dnssecOK = true
+	}
+}
+
+// ParseTrustAnchor 解析 DS 记录的文本形式, 例如 "example.com. IN DS 12345 13 2 ..."
+func ParseTrustAnchor(s string) (*DS, error) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		return nil, err
+	}
+	ds, ok := rr.(*dns.DS)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a DS record", s)
+	}
+	return ds, nil
+}
+
+func mustTrustAnchor(s string) *DS {
+	ds, err := ParseTrustAnchor(s)
+	if err != nil {
+		panic(err)
+	}
+	return ds
+}
+
+// SecurityStatus RFC 4033 5 的四种状态, 按严重程度排序, 多个 RRset 的结果取最严重的
+type SecurityStatus int
+
+const (
+	SecuritySecure        SecurityStatus = iota // 从 trust anchor 开始每一环都验证成功
+	SecurityInsecure                            // 证明了某个委派没有 DS, 之后的记录没有签名
+	SecurityIndeterminate                       // 没有覆盖这个名字的 trust anchor, 或者查询信任链上的记录失败, 不能确定
+	SecurityBogus                               // 签名, 摘要验证失败, 或者缺少应该有的签名和 DS
+)
+
+func (s SecurityStatus) String() string {
+	switch s {
+	case SecuritySecure:
+		return "secure"
+	case SecurityInsecure:
+		return "insecure"
+	case SecurityIndeterminate:
+		return "indeterminate"
+	case SecurityBogus:
+		return "bogus"
+	}
+	return fmt.Sprintf("SecurityStatus(%d)", int(s))
+}
+
+// Link 信任链上的一环, 验证 Zone 的 key 对 Name 的 Type 记录的签名
+type Link struct {
+	Zone   string
+	Name   string
+	Type   uint16
+	KeyTag uint16 // 验证成功的 key, 失败的时候为 0
+	Status SecurityStatus
+	Err    error // 不是 secure 的原因
+}
+
+func (l Link) String() string {
+	s := fmt.Sprintf("%s %s (zone %s", l.Name, dns.TypeToString[l.Type], l.Zone)
+	if l.KeyTag != 0 {
+		s += fmt.Sprintf(", key %d", l.KeyTag)
+	}
+	s += "): " + l.Status.String()
+	if l.Err != nil {
+		s += ": " + l.Err.Error()
+	}
+	return s
+}
+
+type Validation struct {
+	Status SecurityStatus
+	Chain  []Link // 按验证的顺序, 父区在前
+	Failed *Link  // 第一个和 Status 相同的不是 secure 的环节
+}
+
+// zoneKeys 验证过的区的 DNSKEY
+type zoneKeys struct {
+	status SecurityStatus
+	keys   []*dns.DNSKEY
+}
+
+// validator 一次查询的验证, 缓存已经验证过的区
+type validator struct {
+	d     *DNS
+	ctx   context.Context
+	now   time.Time
+	zones map[string]*zoneKeys
+	chain []Link
+}
+
+// rrset 同一个名字和类型的记录, 以及覆盖它的 RRSIG
+type rrset struct {
+	name string
+	typ  uint16
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+func (d *DNS) validate(ctx context.Context, m *dns.Msg) *Validation {
+	v := &validator{d: d, ctx: ctx, now: time.Now(), zones: map[string]*zoneKeys{}}
+	val := &Validation{Status: v.response(m), Chain: v.chain}
+	for i := range val.Chain {
+		if val.Status != SecuritySecure && val.Chain[i].Status == val.Status {
+			val.Failed = &val.Chain[i]
+			break
+		}
+	}
+	return val
+}
+
+// response 验证 answer 中的每个 RRset, 没有查询类型的记录或者 NXDOMAIN 的时候验证 authority 中的否定证明
+func (v *validator) response(m *dns.Msg) SecurityStatus {
+	if len(m.Question) == 0 {
+		return v.link(Link{Status: SecurityIndeterminate, Err: errors.New("no question")})
+	}
+	q := m.Question[0]
+	status := SecuritySecure
+	found := false
+	for _, set := range rrsets(m.Answer) {
+		status = worse(status, v.rrset(set, ""))
+		if set.typ == q.Qtype || q.Qtype == dns.TypeANY {
+			found = true
+		}
+	}
+	if !found || m.Rcode == dns.RcodeNameError {
+		status = worse(status, v.denial(m, q.Name, q.Qtype))
+	}
+	return status
+}
+
+// rrset 用签名者的 key 验证, 没有签名的时候 zone 是不是 insecure 决定结果, zone 为空的时候查询 SOA 找到所在的区
+func (v *validator) rrset(set *rrset, zone string) SecurityStatus {
+	if len(set.sigs) == 0 {
+		if zone == "" {
+			zone = v.zoneOf(set.name)
+		}
+		if zk := v.zoneKeys(zone); zk.status != SecuritySecure {
+			return zk.status
+		}
+		return v.link(Link{Zone: zone, Name: set.name, Type: set.typ, Status: SecurityBogus, Err: errors.New("missing RRSIG")})
+	}
+	signer := dns.CanonicalName(set.sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.name) {
+		return v.link(Link{Zone: signer, Name: set.name, Type: set.typ, Status: SecurityBogus,
+			Err: fmt.Errorf("signer %s is not an ancestor of %s", signer, set.name)})
+	}
+	zk := v.zoneKeys(signer)
+	if zk.status != SecuritySecure {
+		return zk.status
+	}
+	tag, err := v.verify(zk.keys, set)
+	if err != nil {
+		return v.link(Link{Zone: signer, Name: set.name, Type: set.typ, Status: SecurityBogus, Err: err})
+	}
+	return v.link(Link{Zone: signer, Name: set.name, Type: set.typ, KeyTag: tag, Status: SecuritySecure})
+}
+
+// zoneKeys 通过父区的 DS 验证 zone 的 DNSKEY, 父区证明了没有 DS 的时候是 insecure
+func (v *validator) zoneKeys(zone string) *zoneKeys {
+	zone = dns.CanonicalName(zone)
+	if zk, ok := v.zones[zone]; ok {
+		return zk
+	}
+	zk := &zoneKeys{status: SecurityBogus}
+	// 先放进缓存, 错误的签名者不会导致无限递归
+	v.zones[zone] = zk
+	ds, status := v.delegation(zone)
+	if status != SecuritySecure {
+		zk.status = status
+		return zk
+	}
+	m, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		zk.status = v.link(Link{Zone: zone, Name: zone, Type: dns.TypeDNSKEY, Status: SecurityIndeterminate, Err: err})
+		return zk
+	}
+	var set *rrset
+	for _, s := range rrsets(m.Answer) {
+		if s.name == zone && s.typ == dns.TypeDNSKEY {
+			set = s
+		}
+	}
+	if set == nil {
+		v.link(Link{Zone: zone, Name: zone, Type: dns.TypeDNSKEY, Status: SecurityBogus, Err: errors.New("no DNSKEY")})
+		return zk
+	}
+	var keys, trusted []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		if matchDS(key, ds) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		v.link(Link{Zone: zone, Name: zone, Type: dns.TypeDNSKEY, Status: SecurityBogus, Err: errors.New("no DNSKEY matches the DS")})
+		return zk
+	}
+	// DNSKEY 由 DS 对应的 key (KSK) 签名
+	tag, err := v.verify(trusted, set)
+	if err != nil {
+		v.link(Link{Zone: zone, Name: zone, Type: dns.TypeDNSKEY, Status: SecurityBogus, Err: err})
+		return zk
+	}
+	v.link(Link{Zone: zone, Name: zone, Type: dns.TypeDNSKEY, KeyTag: tag, Status: SecuritySecure})
+	zk.status, zk.keys = SecuritySecure, keys
+	return zk
+}
+
+// delegation 返回 zone 的 DS, 来自 trust anchor 或者父区签名的 DS 记录
+func (v *validator) delegation(zone string) ([]*dns.DS, SecurityStatus) {
+	var anchors []*dns.DS
+	for _, ds := range v.d.anchors {
+		if dns.CanonicalName(ds.Hdr.Name) == zone {
+			anchors = append(anchors, ds)
+		}
+	}
+	if len(anchors) > 0 {
+		return anchors, SecuritySecure
+	}
+	if zone == "." {
+		return nil, v.link(Link{Zone: zone, Name: zone, Type: dns.TypeDS, Status: SecurityIndeterminate, Err: errors.New("no trust anchor")})
+	}
+	m, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, v.link(Link{Zone: parentName(zone), Name: zone, Type: dns.TypeDS, Status: SecurityIndeterminate, Err: err})
+	}
+	for _, set := range rrsets(m.Answer) {
+		if set.name != zone || set.typ != dns.TypeDS {
+			continue
+		}
+		if status := v.rrset(set, parentName(zone)); status != SecuritySecure {
+			return nil, status
+		}
+		var ds []*dns.DS
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return ds, SecuritySecure
+	}
+	return nil, v.noDS(m, zone)
+}
+
+// noDS 没有 DS 的时候, 父区需要用 NSEC 或者 NSEC3 证明 DS 不存在
+func (v *validator) noDS(m *dns.Msg, zone string) SecurityStatus {
+	parent := parentName(zone)
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			parent = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+	if zk := v.zoneKeys(parent); zk.status != SecuritySecure {
+		return zk.status
+	}
+	proved := false
+	for _, set := range rrsets(m.Ns) {
+		if set.typ != dns.TypeNSEC && set.typ != dns.TypeNSEC3 {
+			continue
+		}
+		if status := v.rrset(set, parent); status != SecuritySecure {
+			return status
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				proved = proved || (dns.CanonicalName(rr.Hdr.Name) == zone && !hasType(rr.TypeBitMap, dns.TypeDS))
+			case *dns.NSEC3:
+				proved = proved || (rr.Match(zone) && !hasType(rr.TypeBitMap, dns.TypeDS)) ||
+					// opt-out 的 NSEC3 覆盖的委派都可能没有签名
+					(rr.Flags&1 == 1 && rr.Cover(zone))
+			}
+		}
+	}
+	if !proved {
+		return v.link(Link{Zone: parent, Name: zone, Type: dns.TypeDS, Status: SecurityBogus, Err: errors.New("no DS and no proof of its absence")})
+	}
+	return v.link(Link{Zone: parent, Name: zone, Type: dns.TypeDS, Status: SecurityInsecure, Err: errors.New("unsigned delegation")})
+}
+
+// denial 验证 NXDOMAIN 和 NODATA, NSEC/NSEC3 只检查覆盖或者匹配查询的名字, 不检查 closest encloser 和通配符
+func (v *validator) denial(m *dns.Msg, name string, qtype uint16) SecurityStatus {
+	name = dns.CanonicalName(name)
+	zone := ""
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			zone = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+	if zone == "" {
+		zone = v.zoneOf(name)
+	}
+	status := SecuritySecure
+	proved := false
+	nxdomain := m.Rcode == dns.RcodeNameError
+	for _, set := range rrsets(m.Ns) {
+		status = worse(status, v.rrset(set, zone))
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if nxdomain {
+					proved = proved || nsecCover(rr, name)
+				} else {
+					proved = proved || (dns.CanonicalName(rr.Hdr.Name) == name && !hasType(rr.TypeBitMap, qtype))
+				}
+			case *dns.NSEC3:
+				if nxdomain {
+					proved = proved || rr.Cover(name)
+				} else {
+					proved = proved || (rr.Match(name) && !hasType(rr.TypeBitMap, qtype))
+				}
+			}
+		}
+	}
+	if status != SecuritySecure || proved {
+		return status
+	}
+	return v.link(Link{Zone: zone, Name: name, Type: qtype, Status: SecurityBogus, Err: errors.New("no NSEC or NSEC3 proof of non-existence")})
+}
+
+// verify 返回验证成功的 key 的 tag
+func (v *validator) verify(keys []*dns.DNSKEY, set *rrset) (uint16, error) {
+	err := errors.New("no RRSIG")
+	for _, sig := range set.sigs {
+		if !sig.ValidityPeriod(v.now) {
+			err = fmt.Errorf("RRSIG %d expired or not yet valid", sig.KeyTag)
+			continue
+		}
+		err = fmt.Errorf("no DNSKEY with key tag %d", sig.KeyTag)
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err = sig.Verify(key, set.rrs); err == nil {
+				return key.KeyTag(), nil
+			}
+			err = fmt.Errorf("RRSIG %d: %w", sig.KeyTag, err)
+		}
+	}
+	return 0, err
+}
+
+// zoneOf 通过 SOA 查询 name 所在的区
+func (v *validator) zoneOf(name string) string {
+	m, err := v.query(name, dns.TypeSOA)
+	if err != nil {
+		return parentName(name)
+	}
+	for _, rr := range append(m.Answer, m.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+	return parentName(name)
+}
+
+func (v *validator) query(name string, t uint16) (*dns.Msg, error) {
+	r, err := v.d.exchange(v.ctx, v.d.newMsg(name, t))
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, &RcodeError{Rcode: r.Rcode, Response: r}
+	}
+	return r.Msg, nil
+}
+
+func (v *validator) link(l Link) SecurityStatus {
+	v.chain = append(v.chain, l)
+	return l.Status
+}
+
+// rrsets 按名字和类型分组, RRSIG 放到它覆盖的 RRset 中
+func rrsets(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	find := func(name string, t uint16) *rrset {
+		for _, set := range sets {
+			if set.name == name && set.typ == t {
+				return set
+			}
+		}
+		set := &rrset{name: name, typ: t}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.OPT:
+		case *dns.RRSIG:
+			set := find(name, rr.TypeCovered)
+			set.sigs = append(set.sigs, rr)
+		default:
+			set := find(name, rr.Header().Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	// 只有 RRSIG 没有记录的不算
+	n := 0
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			sets[n] = set
+			n++
+		}
+	}
+	return sets[:n]
+}
+
+func matchDS(key *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+			continue
+		}
+		if kds := key.ToDS(d.DigestType); kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCover name 在 NSEC 的 owner 和 next 之间, next 是区的顶点的时候是最后一个 NSEC
+func nsecCover(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// canonicalCompare RFC 4034 6.1 的规范顺序, 从最右边的 label 开始按字节比较
+func canonicalCompare(a, b string) int {
+	la, lb := canonicalLabels(a), canonicalLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := bytes.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// canonicalLabels 转义 (例如 \001) 转换成原始的字节, 只有 ASCII 大写字母转换成小写
+func canonicalLabels(name string) [][]byte {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		n = 0
+	}
+	var labels [][]byte
+	for off := 0; off < n && buf[off] != 0; off += int(buf[off]) + 1 {
+		label := buf[off+1 : off+1+int(buf[off])]
+		for i, c := range label {
+			if 'A' <= c && c <= 'Z' {
+				label[i] = c + 'a' - 'A'
+			}
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+func parentName(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+func worse(a, b SecurityStatus) SecurityStatus {
+	if b > a {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,394 @@
+package dns
+
+import (
+	"crypto"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer 在 127.0.0.1 的随机端口启动 udp 服务器, 返回地址
+func startServer(t *testing.T, handler dns.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// testZone 本地签名的区, ksk 签名 DNSKEY, zsk 签名其它记录
+type testZone struct {
+	name     string
+	signed   bool
+	ksk, zsk *dns.DNSKEY
+	kp, zp   crypto.Signer
+	rrs      []dns.RR
+}
+
+func newTestKey(t *testing.T, name string, flags uint16) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags: flags, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	p, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, p.(crypto.Signer)
+}
+
+func newTestZone(t *testing.T, name string, signed bool) *testZone {
+	z := &testZone{name: name, signed: signed}
+	z.rrs = []dns.RR{newRR(t, name+" 300 IN SOA ns.lab. h.lab. 1 3600 600 86400 300"), newRR(t, name+" 300 IN NS ns.lab.")}
+	if signed {
+		z.ksk, z.kp = newTestKey(t, name, 257)
+		z.zsk, z.zp = newTestKey(t, name, 256)
+		z.rrs = append(z.rrs, z.ksk, z.zsk)
+	}
+	return z
+}
+
+// sign badsig. 开头的名字的签名被修改, expired. 开头的名字的签名已经过期
+func (z *testZone) sign(set []dns.RR) []dns.RR {
+	if !z.signed || len(set) == 0 {
+		return nil
+	}
+	key, p := z.zsk, z.zp
+	if set[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, p = z.ksk, z.kp
+	}
+	name := set[0].Header().Name
+	now := time.Now()
+	sig := &dns.RRSIG{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		Inception: uint32(now.Add(-time.Hour).Unix()), Expiration: uint32(now.Add(time.Hour).Unix()),
+		KeyTag: key.KeyTag(), SignerName: z.name, Algorithm: key.Algorithm}
+	if strings.HasPrefix(name, "expired.") {
+		sig.Inception, sig.Expiration = uint32(now.Add(-48*time.Hour).Unix()), uint32(now.Add(-24*time.Hour).Unix())
+	}
+	if err := sig.Sign(p, set); err != nil {
+		panic(err)
+	}
+	if strings.HasPrefix(name, "badsig.") {
+		b, _ := base64.StdEncoding.DecodeString(sig.Signature)
+		b[5] ^= 1
+		sig.Signature = base64.StdEncoding.EncodeToString(b)
+	}
+	return []dns.RR{sig}
+}
+
+func (z *testZone) owners() []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, rr := range z.rrs {
+		if name := rr.Header().Name; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	return names
+}
+
+// nsec 匹配 name 或者覆盖 name 的 NSEC
+func (z *testZone) nsec(name string, cover bool) []dns.RR {
+	if !z.signed {
+		return nil
+	}
+	owners := z.owners()
+	i := -1
+	for j, owner := range owners {
+		if (cover && canonicalCompare(owner, name) < 0) || (!cover && owner == name) {
+			i = j
+		}
+	}
+	if i < 0 {
+		return nil
+	}
+	types := map[uint16]bool{dns.TypeRRSIG: true, dns.TypeNSEC: true}
+	for _, rr := range z.rrs {
+		if rr.Header().Name == owners[i] {
+			types[rr.Header().Rrtype] = true
+		}
+	}
+	nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: owners[i], Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: owners[(i+1)%len(owners)]}
+	for t := range types {
+		nsec.TypeBitMap = append(nsec.TypeBitMap, t)
+	}
+	sort.Slice(nsec.TypeBitMap, func(i, j int) bool { return nsec.TypeBitMap[i] < nsec.TypeBitMap[j] })
+	return append([]dns.RR{nsec}, z.sign([]dns.RR{nsec})...)
+}
+
+// testHierarchy . -> lab. -> secure.lab. (签名), insecure.lab. (没有 DS), bogus.lab. (DS 不匹配), fail.lab. (DNSKEY 查询失败)
+type testHierarchy struct {
+	zones []*testZone
+	root  *DS
+}
+
+func newTestHierarchy(t *testing.T) *testHierarchy {
+	root := newTestZone(t, ".", true)
+	lab := newTestZone(t, "lab.", true)
+	secure := newTestZone(t, "secure.lab.", true)
+	insecure := newTestZone(t, "insecure.lab.", false)
+	bogus := newTestZone(t, "bogus.lab.", true)
+	fail := newTestZone(t, "fail.lab.", true)
+	root.rrs = append(root.rrs, newRR(t, "lab. 300 IN NS ns.lab."), lab.ksk.ToDS(dns.SHA256))
+	ds := bogus.ksk.ToDS(dns.SHA256)
+	ds.Digest = strings.Repeat("0", len(ds.Digest))
+	lab.rrs = append(lab.rrs, newRR(t, "ns.lab. 300 IN A 127.0.0.1"),
+		newRR(t, "secure.lab. 300 IN NS ns.lab."), secure.ksk.ToDS(dns.SHA256),
+		newRR(t, "insecure.lab. 300 IN NS ns.lab."),
+		newRR(t, "bogus.lab. 300 IN NS ns.lab."), ds,
+		newRR(t, "fail.lab. 300 IN NS ns.lab."), fail.ksk.ToDS(dns.SHA256))
+	secure.rrs = append(secure.rrs, newRR(t, "www.secure.lab. 300 IN A 10.0.0.1"),
+		newRR(t, "badsig.secure.lab. 300 IN A 10.0.0.2"),
+		newRR(t, "expired.secure.lab. 300 IN A 10.0.0.3"),
+		newRR(t, "nosig.secure.lab. 300 IN A 10.0.0.4"))
+	insecure.rrs = append(insecure.rrs, newRR(t, "www.insecure.lab. 300 IN A 10.0.1.1"))
+	bogus.rrs = append(bogus.rrs, newRR(t, "www.bogus.lab. 300 IN A 10.0.2.1"))
+	fail.rrs = append(fail.rrs, newRR(t, "www.fail.lab. 300 IN A 10.0.3.1"))
+	return &testHierarchy{zones: []*testZone{root, lab, secure, insecure, bogus, fail}, root: root.ksk.ToDS(dns.SHA256)}
+}
+
+// find name 所在的区, DS 在父区
+func (h *testHierarchy) find(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range h.zones {
+		if qtype == dns.TypeDS && z.name == name && name != "." {
+			continue
+		}
+		if dns.IsSubDomain(z.name, name) && (best == nil || dns.CountLabel(z.name) > dns.CountLabel(best.name)) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (h *testHierarchy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetEdns0(DefaultEDNS0Size, true)
+	z := h.find(name, q.Qtype)
+	if z.name == "fail.lab." && q.Qtype == dns.TypeDNSKEY {
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	var set []dns.RR
+	exists := false
+	for _, rr := range z.rrs {
+		if rr.Header().Name == name {
+			exists = true
+			if rr.Header().Rrtype == q.Qtype {
+				set = append(set, rr)
+			}
+		}
+	}
+	if len(set) > 0 {
+		m.Answer = append(m.Answer, set...)
+		if !strings.HasPrefix(name, "nosig.") {
+			m.Answer = append(m.Answer, z.sign(set)...)
+		}
+	} else {
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = append(append(m.Ns, z.rrs[0]), z.sign(z.rrs[:1])...)
+		if !strings.HasPrefix(name, "noproof.") {
+			m.Ns = append(m.Ns, z.nsec(name, !exists)...)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// RFC 4034 6.1 的例子
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		`\001.z.example.`,
+		"*.z.example.",
+		`\200.z.example.`,
+	}
+	for i := range names {
+		for j := range names {
+			c := canonicalCompare(names[i], names[j])
+			if (i < j && c >= 0) || (i == j && c != 0) || (i > j && c <= 0) {
+				t.Errorf("canonicalCompare(%q, %q) = %d", names[i], names[j], c)
+			}
+		}
+	}
+}
+
+func TestNSECCover(t *testing.T) {
+	tests := []struct {
+		owner, next string
+		name        string
+		cover       bool
+	}{
+		{"a.example.", "d.example.", "b.example.", true},
+		{"a.example.", "d.example.", "x.b.example.", true},
+		{"a.example.", "d.example.", "A.example.", false},
+		{"a.example.", "d.example.", "d.example.", false},
+		{"a.example.", "d.example.", "e.example.", false},
+		{"a.example.", "d.example.", "x.a.example.", true},
+		// 最后一个 NSEC, next 是区的顶点
+		{"z.example.", "example.", "zz.example.", true},
+		{"z.example.", "example.", "x.z.example.", true},
+		{"z.example.", "example.", "b.example.", false},
+		{"z.example.", "example.", "example.", false},
+		{"z.example.", "example.", "a.other.", false},
+	}
+	for _, tt := range tests {
+		nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: tt.owner}, NextDomain: tt.next}
+		if cover := nsecCover(nsec, tt.name); cover != tt.cover {
+			t.Errorf("nsecCover(%s -> %s, %s) = %v, want %v", tt.owner, tt.next, tt.name, cover, tt.cover)
+		}
+	}
+}
+
+func TestMatchDS(t *testing.T) {
+	key, _ := newTestKey(t, "example.", 257)
+	other, _ := newTestKey(t, "example.", 257)
+	sha256 := key.ToDS(dns.SHA256)
+	upper := key.ToDS(dns.SHA256)
+	upper.Digest = strings.ToLower(upper.Digest)
+	wrongDigest := key.ToDS(dns.SHA256)
+	wrongDigest.Digest = strings.Repeat("0", len(wrongDigest.Digest))
+	wrongAlgorithm := key.ToDS(dns.SHA256)
+	wrongAlgorithm.Algorithm = dns.RSASHA256
+	tests := []struct {
+		name  string
+		ds    []*dns.DS
+		match bool
+	}{
+		{"sha256", []*dns.DS{sha256}, true},
+		{"sha384", []*dns.DS{key.ToDS(dns.SHA384)}, true},
+		{"sha1", []*dns.DS{key.ToDS(dns.SHA1)}, true},
+		{"case insensitive digest", []*dns.DS{upper}, true},
+		{"one of", []*dns.DS{other.ToDS(dns.SHA256), sha256}, true},
+		{"other key", []*dns.DS{other.ToDS(dns.SHA256)}, false},
+		{"wrong digest", []*dns.DS{wrongDigest}, false},
+		{"wrong algorithm", []*dns.DS{wrongAlgorithm}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if match := matchDS(key, tt.ds); match != tt.match {
+			t.Errorf("%s: matchDS = %v, want %v", tt.name, match, tt.match)
+		}
+	}
+}
+
+func TestParseTrustAnchor(t *testing.T) {
+	ds, err := ParseTrustAnchor("example.com. IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Hdr.Name != "example.com." || ds.KeyTag != 12345 || ds.Algorithm != 13 || ds.DigestType != 2 {
+		t.Fatalf("ParseTrustAnchor = %v", ds)
+	}
+	for _, s := range []string{"example.com. IN A 192.0.2.1", "example.com. IN DS 12345", "not a record"} {
+		if _, err := ParseTrustAnchor(s); err == nil {
+			t.Errorf("ParseTrustAnchor(%q) error = nil", s)
+		}
+	}
+	if len(RootTrustAnchors) != 2 || RootTrustAnchors[0].KeyTag != 20326 || RootTrustAnchors[1].KeyTag != 38696 {
+		t.Fatalf("RootTrustAnchors = %v", RootTrustAnchors)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	h := newTestHierarchy(t)
+	addr := startServer(t, h)
+	other := mustTrustAnchor("other. IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	tests := []struct {
+		name    string
+		qtype   uint16
+		anchors []*DS
+		status  SecurityStatus
+		failed  string // Failed 的 Name 和错误中的字符串
+		err     string
+	}{
+		{"www.secure.lab.", TypeA, nil, SecuritySecure, "", ""},
+		{"secure.lab.", TypeSOA, nil, SecuritySecure, "", ""},
+		{"nx.secure.lab.", TypeA, nil, SecuritySecure, "", ""},
+		{"www.secure.lab.", TypeTXT, nil, SecuritySecure, "", ""},
+		{"www.insecure.lab.", TypeA, nil, SecurityInsecure, "insecure.lab.", "unsigned delegation"},
+		{"badsig.secure.lab.", TypeA, nil, SecurityBogus, "badsig.secure.lab.", "bad signature"},
+		{"expired.secure.lab.", TypeA, nil, SecurityBogus, "expired.secure.lab.", "expired"},
+		{"nosig.secure.lab.", TypeA, nil, SecurityBogus, "nosig.secure.lab.", "missing RRSIG"},
+		{"noproof.secure.lab.", TypeA, nil, SecurityBogus, "noproof.secure.lab.", "no NSEC"},
+		{"www.bogus.lab.", TypeA, nil, SecurityBogus, "bogus.lab.", "no DNSKEY matches the DS"},
+		{"www.fail.lab.", TypeA, nil, SecurityIndeterminate, "fail.lab.", "SERVFAIL"},
+		{"www.secure.lab.", TypeA, []*DS{other}, SecurityIndeterminate, ".", "no trust anchor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			anchors := tt.anchors
+			if anchors == nil {
+				anchors = []*DS{h.root}
+			}
+			r, err := NewDNS(addr, ValidateOption(anchors...)).Query(tt.name, tt.qtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			val := r.Validation
+			if val == nil {
+				t.Fatal("Validation = nil")
+			}
+			if val.Status != tt.status {
+				t.Fatalf("Status = %v, want %v, chain %v", val.Status, tt.status, val.Chain)
+			}
+			if tt.status == SecuritySecure {
+				if val.Failed != nil {
+					t.Fatalf("Failed = %v, want nil", val.Failed)
+				}
+				for _, l := range val.Chain {
+					if l.Status != SecuritySecure || l.KeyTag == 0 {
+						t.Fatalf("chain link %v is not secure", l)
+					}
+				}
+				return
+			}
+			if val.Failed == nil || val.Failed.Status != tt.status || val.Failed.Name != tt.failed ||
+				val.Failed.Err == nil || !strings.Contains(val.Failed.Err.Error(), tt.err) {
+				t.Fatalf("Failed = %v, want %s %v %q", val.Failed, tt.failed, tt.status, tt.err)
+			}
+		})
+	}
+}
+
+func TestSecurityStatusOrder(t *testing.T) {
+	statuses := []SecurityStatus{SecuritySecure, SecurityInsecure, SecurityIndeterminate, SecurityBogus}
+	for i := 1; i < len(statuses); i++ {
+		if worse(statuses[i-1], statuses[i]) != statuses[i] || worse(statuses[i], statuses[i-1]) != statuses[i] {
+			t.Errorf("worse(%v, %v) != %v", statuses[i-1], statuses[i], statuses[i])
+		}
+	}
+	if s := SecurityIndeterminate.String(); s != "indeterminate" {
+		t.Errorf("String = %q", s)
+	}
+}
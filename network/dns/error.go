@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+)
+
+type ErrorKind int
+
+const (
+	ErrorTimeout   ErrorKind = iota + 1 // 超时没有收到响应
+	ErrorRefused                        // 连接被拒绝, udp 是收到了 icmp port unreachable
+	ErrorTruncated                      // 响应被截断 (TC), 需要通过 tcp 重新查询
+	ErrorNetwork                        // 其它的网络错误
+	ErrorTLS                            // DoT 和 DoH 的 TLS 握手失败, 包括证书验证和 pin 不匹配
+	ErrorHTTP                           // DoH 的响应状态码不是 200 或者内容不是 DNS 报文
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorRefused:
+		return "refused"
+	case ErrorTruncated:
+		return "truncated"
+	case ErrorNetwork:
+		return "network"
+	case ErrorTLS:
+		return "tls"
+	case ErrorHTTP:
+		return "http"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// Error 传输的错误, 没有得到完整的响应
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// RcodeError Exchange 收到的响应不是 NOERROR, Query 不会返回这个错误, 而是在 Response.Rcode 中
+type RcodeError struct {
+	Rcode    int
+	Response *Response
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("failed to get an valid answer %v %s", e.Rcode, dns.RcodeToString[e.Rcode])
+}
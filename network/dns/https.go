@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const dnsMessage = "application/dns-message"
+
+// HTTPMethodOption DoH 的请求方法, http.MethodGet 或者 http.MethodPost, 默认 POST
+func HTTPMethodOption(method string) Option {
+	return func(m *DNS) {
+		m.method = method
+	}
+}
+
+// isHTTPS nameserver 是 https:// 开头的 url 的时候使用 DNS over HTTPS (RFC 8484), 例如 https://dns.google/dns-query
+func (d *DNS) isHTTPS() bool {
+	return strings.HasPrefix(d.nameserver, "https://")
+}
+
+// exchangeHTTPS 每次查询都建立新的连接, 结果包含 tcp 和 tls 的耗时
+func (d *DNS) exchangeHTTPS(ctx context.Context, m *dns.Msg) (*Response, error) {
+	u, err := url.Parse(d.nameserver)
+	if err != nil {
+		return nil, &Error{Kind: ErrorNetwork, Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// RFC 8484 4.1 id 为 0, 相同的查询可以被 http 缓存
+	m.Id = 0
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	var req *http.Request
+	if d.method == http.MethodGet {
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessage)
+		}
+	}
+	if err != nil {
+		return nil, &Error{Kind: ErrorNetwork, Err: err}
+	}
+	req.Header.Set("Accept", dnsMessage)
+
+	var connectStart, connectDone, tlsStart, tlsDone, gotConn, wroteRequest, firstByte time.Time
+	var handshakeErr error
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			connectDone = time.Now()
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			tlsDone, handshakeErr = time.Now(), err
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			gotConn = time.Now()
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			firstByte = time.Now()
+		},
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   d.newTLSConfig(u.Hostname()),
+			DisableKeepAlives: true,
+			ForceAttemptHTTP2: true,
+		},
+	}
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	if err != nil {
+		if handshakeErr != nil {
+			return nil, tlsErr(ctx, handshakeErr)
+		}
+		return nil, transportErr(ctx, err)
+	}
+	defer resp.Body.Close()
+	// 最大的 DNS 报文是 65535 字节
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, transportErr(ctx, err)
+	}
+	done := time.Now()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Error{Kind: ErrorHTTP, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dnsMessage) {
+		return nil, &Error{Kind: ErrorHTTP, Err: fmt.Errorf("unexpected content type %q", ct)}
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, &Error{Kind: ErrorHTTP, Err: err}
+	}
+	timing := Timing{
+		Connection:       connectDone.Sub(connectStart),
+		TLSHandshake:     tlsDone.Sub(tlsStart),
+		QueryWrite:       wroteRequest.Sub(gotConn),
+		ServerProcessing: firstByte.Sub(wroteRequest),
+		ContentTransfer:  done.Sub(firstByte),
+		Total:            done.Sub(start),
+	}
+	response := newResponse(r, timing.QueryWrite+timing.ServerProcessing+timing.ContentTransfer)
+	response.TLS, response.Timing = resp.TLS, timing
+	return response, nil
+}
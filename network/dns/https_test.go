@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// dohHandler RFC 8484 的服务器, 记录收到的请求方法, /html 返回网页, /missing 返回 404
+type dohHandler struct {
+	mu      sync.Mutex
+	methods []string
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/html":
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+		return
+	case "/missing":
+		http.NotFound(w, r)
+		return
+	}
+	var buf []byte
+	var err error
+	if r.Method == http.MethodGet {
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	} else if r.Header.Get("Content-Type") == dnsMessage {
+		buf, err = ioutil.ReadAll(r.Body)
+	} else {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err != nil || req.Id != 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	h.methods = append(h.methods, r.Method)
+	h.mu.Unlock()
+	rw := &responseRecorder{}
+	answerHandler.ServeDNS(rw, req)
+	out, _ := rw.m.Pack()
+	w.Header().Set("Content-Type", dnsMessage)
+	w.Write(out)
+}
+
+// responseRecorder 只记录 WriteMsg 的报文
+type responseRecorder struct {
+	dns.ResponseWriter
+	m *dns.Msg
+}
+
+func (r *responseRecorder) WriteMsg(m *dns.Msg) error {
+	r.m = m
+	return nil
+}
+
+func (r *responseRecorder) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestDoH(t *testing.T) {
+	h := &dohHandler{}
+	srv := httptest.NewUnstartedServer(h)
+	// 握手失败的用例不打印服务器的日志
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	trusted := TLSOption(&tls.Config{RootCAs: pool})
+	tests := []struct {
+		name   string
+		path   string
+		opts   []Option
+		method string
+		kind   ErrorKind // 0 表示成功
+		err    string
+	}{
+		{"post", "/dns-query", []Option{trusted}, http.MethodPost, 0, ""},
+		{"get", "/dns-query", []Option{trusted, HTTPMethodOption(http.MethodGet)}, http.MethodGet, 0, ""},
+		{"pin", "/dns-query", []Option{PinOption(SPKIPin(srv.Certificate()))}, http.MethodPost, 0, ""},
+		{"untrusted", "/dns-query", nil, "", ErrorTLS, "unknown authority"},
+		{"pin mismatch", "/dns-query", []Option{PinOption(strings.Repeat("A", 43) + "=")}, "", ErrorTLS, "pinned"},
+		{"status", "/missing", []Option{trusted}, "", ErrorHTTP, "404"},
+		{"content type", "/html", []Option{trusted}, "", ErrorHTTP, "text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.mu.Lock()
+			h.methods = nil
+			h.mu.Unlock()
+			r, err := NewDNS(srv.URL+tt.path, tt.opts...).Query("www.example.com", TypeA)
+			if tt.kind != 0 {
+				if errorKind(err) != tt.kind || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %v %q", err, tt.kind, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Strings(TypeA); len(got) != 1 || got[0] != "192.0.2.1" {
+				t.Fatalf("answer = %v", got)
+			}
+			h.mu.Lock()
+			methods := h.methods
+			h.mu.Unlock()
+			if len(methods) != 1 || methods[0] != tt.method {
+				t.Fatalf("methods = %v, want [%s]", methods, tt.method)
+			}
+			if r.TLS == nil || r.Timing.TLSHandshake <= 0 || r.Timing.Total <= 0 {
+				t.Fatalf("TLS = %v, Timing = %+v", r.TLS, r.Timing)
+			}
+		})
+	}
+}
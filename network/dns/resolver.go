@@ -0,0 +1,39 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// LookupIPAddr 通过 nameserver 查询 A 和 AAAA 记录, 实现 network.Resolver
+func (d *DNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	var (
+		addrs    []net.IPAddr
+		firstErr error
+	)
+	for _, t := range []uint16{TypeA, TypeAAAA} {
+		_, result, err := d.ExchangeContext(ctx, host, t)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, s := range result {
+			if ip := net.ParseIP(s); ip != nil {
+				addrs = append(addrs, net.IPAddr{IP: ip})
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	return addrs, nil
+}
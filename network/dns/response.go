@@ -0,0 +1,169 @@
+package dns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+type Section int
+
+const (
+	SectionAnswer Section = iota
+	SectionAuthority
+	SectionAdditional
+)
+
+func (s Section) String() string {
+	switch s {
+	case SectionAnswer:
+		return "answer"
+	case SectionAuthority:
+		return "authority"
+	case SectionAdditional:
+		return "additional"
+	}
+	return fmt.Sprintf("Section(%d)", int(s))
+}
+
+// Record 一条资源记录, RR 是 miekg/dns 的具体类型, 例如 *dns.SOA, 可以通过类型断言读取每个字段
+type Record struct {
+	Section Section
+	Name    string
+	Type    uint16
+	Class   uint16
+	TTL     uint32
+	Data    string // rdata 的文本形式, 例如 MX 是 "10 mail.example.com."
+	RR      dns.RR
+}
+
+func (r Record) String() string {
+	return r.RR.String()
+}
+
+// Flags 响应报文头的标志位
+type Flags struct {
+	Authoritative      bool // AA
+	Truncated          bool // TC
+	RecursionDesired   bool // RD
+	RecursionAvailable bool // RA
+	AuthenticatedData  bool // AD
+	CheckingDisabled   bool // CD
+}
+
+type Response struct {
+	Rcode   int
+	Flags   Flags
+	Records []Record      // 按 answer, authority, additional 的顺序, 不包含 EDNS0 的 OPT 伪记录
+	RTT     time.Duration // 发送查询到读完响应, 不包括建立连接和 TLS 握手
+	Msg     *dns.Msg      // 原始的响应报文
+
+	TLS    *tls.ConnectionState // DoT 和 DoH 的连接信息, 例如协议版本和服务器证书
+	Timing Timing
+
+	TruncatedUDP *Response // TCPFallbackOption 重新查询之前被截断的 udp 响应, 包括它的 RTT 和 Timing, 没有重新查询的时候为 nil
+
+	Validation *Validation // ValidateOption 的验证结果, 没有验证的时候为 nil
+}
+
+func newResponse(m *dns.Msg, rtt time.Duration) *Response {
+	r := &Response{
+		Rcode: m.Rcode,
+		Flags: Flags{
+			Authoritative:      m.Authoritative,
+			Truncated:          m.Truncated,
+			RecursionDesired:   m.RecursionDesired,
+			RecursionAvailable: m.RecursionAvailable,
+			AuthenticatedData:  m.AuthenticatedData,
+			CheckingDisabled:   m.CheckingDisabled,
+		},
+		RTT: rtt,
+		Msg: m,
+	}
+	for section, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); ok {
+				continue
+			}
+			h := rr.Header()
+			r.Records = append(r.Records, Record{
+				Section: Section(section),
+				Name:    h.Name,
+				Type:    h.Rrtype,
+				Class:   h.Class,
+				TTL:     h.Ttl,
+				Data:    strings.TrimPrefix(rr.String(), h.String()),
+				RR:      rr,
+			})
+		}
+	}
+	return r
+}
+
+func (r *Response) RcodeString() string {
+	if s, ok := dns.RcodeToString[r.Rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", r.Rcode)
+}
+
+// Section section 中所有的记录
+func (r *Response) Section(section Section) []Record {
+	var records []Record
+	for _, record := range r.Records {
+		if record.Section == section {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func (r *Response) Answer() []Record {
+	return r.Section(SectionAnswer)
+}
+
+func (r *Response) Authority() []Record {
+	return r.Section(SectionAuthority)
+}
+
+func (r *Response) Additional() []Record {
+	return r.Section(SectionAdditional)
+}
+
+// Strings Exchange 返回的字符串形式, answer 中类型为 t (TypeANY 的时候是所有类型) 的记录,
+// TXT 的每个字符串是一项, MX 只有主机名, 其它类型是 Data
+func (r *Response) Strings(t uint16) []string {
+	var result []string
+	for _, record := range r.Answer() {
+		if t != TypeANY && record.Type != t {
+			continue
+		}
+		switch rr := record.RR.(type) {
+		case *dns.A:
+			result = append(result, rr.A.String())
+		case *dns.AAAA:
+			result = append(result, rr.AAAA.String())
+		case *dns.TXT:
+			result = append(result, rr.Txt...)
+		case *dns.MX:
+			result = append(result, rr.Mx)
+		case *dns.CNAME:
+			result = append(result, rr.Target)
+		case *dns.PTR:
+			result = append(result, rr.Ptr)
+		case *dns.NS:
+			result = append(result, rr.Ns)
+		default:
+			result = append(result, record.Data)
+		}
+	}
+	return result
+}
+
+// ParseType 例如 "AAAA" 返回 TypeAAAA
+func ParseType(s string) (uint16, bool) {
+	t, ok := dns.StringToType[strings.ToUpper(s)]
+	return t, ok
+}
@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"github.com/miekg/dns"
+	"reflect"
+	"testing"
+)
+
+// recordsHandler answer 中是 A, AAAA, CNAME, MX 和 TXT, authority 是 NS, additional 是 NS 的 glue
+var recordsHandler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative, m.RecursionAvailable = true, true
+	add := func(rrs *[]dns.RR, s string) {
+		rr, _ := dns.NewRR(s)
+		*rrs = append(*rrs, rr)
+	}
+	add(&m.Answer, "www.example.com. 300 IN CNAME web.example.com.")
+	add(&m.Answer, "web.example.com. 60 IN A 192.0.2.1")
+	add(&m.Answer, "web.example.com. 120 IN AAAA 2001:db8::1")
+	add(&m.Answer, "web.example.com. 3600 IN MX 10 mail.example.com.")
+	add(&m.Answer, `web.example.com. 30 IN TXT "v=spf1 -all" "second"`)
+	add(&m.Ns, "example.com. 86400 IN NS ns1.example.com.")
+	add(&m.Extra, "ns1.example.com. 7200 IN A 192.0.2.53")
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+	}
+	w.WriteMsg(m)
+})
+
+func TestResponse(t *testing.T) {
+	r, err := NewDNS(startServer(t, recordsHandler), EDNS0Option(DefaultEDNS0Size)).Query("www.example.com", TypeANY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || r.RcodeString() != "NOERROR" {
+		t.Fatalf("rcode = %d %s", r.Rcode, r.RcodeString())
+	}
+	if want := (Flags{Authoritative: true, RecursionDesired: true, RecursionAvailable: true}); r.Flags != want {
+		t.Fatalf("flags = %+v, want %+v", r.Flags, want)
+	}
+	if r.Msg.IsEdns0() == nil {
+		t.Fatal("response has no OPT")
+	}
+	// OPT 不在 Records 中
+	want := []struct {
+		section Section
+		name    string
+		typ     uint16
+		ttl     uint32
+		data    string
+	}{
+		{SectionAnswer, "www.example.com.", dns.TypeCNAME, 300, "web.example.com."},
+		{SectionAnswer, "web.example.com.", dns.TypeA, 60, "192.0.2.1"},
+		{SectionAnswer, "web.example.com.", dns.TypeAAAA, 120, "2001:db8::1"},
+		{SectionAnswer, "web.example.com.", dns.TypeMX, 3600, "10 mail.example.com."},
+		{SectionAnswer, "web.example.com.", dns.TypeTXT, 30, `"v=spf1 -all" "second"`},
+		{SectionAuthority, "example.com.", dns.TypeNS, 86400, "ns1.example.com."},
+		{SectionAdditional, "ns1.example.com.", dns.TypeA, 7200, "192.0.2.53"},
+	}
+	if len(r.Records) != len(want) {
+		t.Fatalf("records = %v", r.Records)
+	}
+	for i, w := range want {
+		record := r.Records[i]
+		if record.Section != w.section || record.Name != w.name || record.Type != w.typ ||
+			record.Class != dns.ClassINET || record.TTL != w.ttl || record.Data != w.data {
+			t.Fatalf("record %d = %s %+v, want %+v", i, record.Section, record, w)
+		}
+		if record.RR.Header().Rrtype != w.typ || record.String() != record.RR.String() {
+			t.Fatalf("record %d RR = %v", i, record.RR)
+		}
+	}
+	if mx, ok := r.Records[3].RR.(*dns.MX); !ok || mx.Preference != 10 || mx.Mx != "mail.example.com." {
+		t.Fatalf("MX = %#v", r.Records[3].RR)
+	}
+
+	if n := []int{len(r.Answer()), len(r.Authority()), len(r.Additional())}; !reflect.DeepEqual(n, []int{5, 1, 1}) {
+		t.Fatalf("answer/authority/additional = %v, want [5 1 1]", n)
+	}
+	types := []struct {
+		t    uint16
+		want []string
+	}{
+		{TypeA, []string{"192.0.2.1"}},
+		{TypeAAAA, []string{"2001:db8::1"}},
+		{TypeCNAME, []string{"web.example.com."}},
+		{TypeMX, []string{"mail.example.com."}},
+		{TypeTXT, []string{"v=spf1 -all", "second"}},
+		// 只有 answer
+		{TypeNS, nil},
+		{TypeANY, []string{"web.example.com.", "192.0.2.1", "2001:db8::1", "mail.example.com.", "v=spf1 -all", "second"}},
+	}
+	for _, tt := range types {
+		if got := r.Strings(tt.t); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("Strings(%s) = %q, want %q", dns.TypeToString[tt.t], got, tt.want)
+		}
+	}
+}
+
+func TestParseType(t *testing.T) {
+	for s, want := range map[string]uint16{"A": TypeA, "aaaa": TypeAAAA, "Mx": TypeMX, "txt": TypeTXT} {
+		if got, ok := ParseType(s); !ok || got != want {
+			t.Fatalf("ParseType(%q) = %d, %v, want %d", s, got, ok, want)
+		}
+	}
+	if _, ok := ParseType("BOGUS"); ok {
+		t.Fatal("ParseType(BOGUS) ok")
+	}
+}
@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Timing 查询每个阶段的耗时, 和 http.Result 相同的划分
+type Timing struct {
+	Connection       time.Duration // 创建 socket, tcp 包括建立连接
+	TLSHandshake     time.Duration // DoT 和 DoH
+	QueryWrite       time.Duration // 写入查询报文, DoH 是整个 http 请求
+	ServerProcessing time.Duration // 写完查询到收到响应的第一个字节
+	ContentTransfer  time.Duration // 第一个字节到读完响应, udp 是 0
+	Total            time.Duration
+}
+
+func (t Timing) Format(s fmt.State, verb rune) {
+	fmt.Fprintf(s, "Connection:        %v\n", t.Connection)
+	if t.TLSHandshake > 0 {
+		fmt.Fprintf(s, "TLS handshake:     %v\n", t.TLSHandshake)
+	}
+	fmt.Fprintf(s, "Query write:       %v\n", t.QueryWrite)
+	fmt.Fprintf(s, "Server processing: %v\n", t.ServerProcessing)
+	if t.ContentTransfer > 0 {
+		fmt.Fprintf(s, "Content transfer:  %v\n", t.ContentTransfer)
+	}
+	fmt.Fprintf(s, "Total:             %v\n", t.Total)
+}
+
+// firstByteConn 记录第一次读到数据的时间, 只用于 tcp, udp 的响应是一个完整的报文
+type firstByteConn struct {
+	net.Conn
+	first time.Time
+}
+
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.first.IsZero() {
+		c.first = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// TLSOption 使用 DNS over TLS (RFC 7858), nameserver 没有端口的时候默认 853,
+// config 为 nil 或者没有 ServerName 的时候, SNI 是 nameserver 的主机名, nameserver 是 DoH 的 url 的时候只使用 config
+func TLSOption(config *tls.Config) Option {
+	return func(m *DNS) {
+		m.network = "tcp-tls"
+		m.tlsConfig = config
+	}
+}
+
+// PinOption 服务器证书链中至少有一个证书的公钥匹配 pins 中的一个, pin 是 SPKI 的 SHA-256 的 base64, 参考 SPKIPin.
+// 设置之后只验证公钥, 不再验证证书链和主机名, DoT 和 DoH 都有效
+func PinOption(pins ...string) Option {
+	return func(m *DNS) {
+		m.pins = pins
+	}
+}
+
+// SPKIPin 返回证书公钥的 pin, 和 openssl x509 -pubkey | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64 的结果相同
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newTLSConfig host 是 nameserver 的主机名或者 ip
+func (d *DNS) newTLSConfig(host string) *tls.Config {
+	var config *tls.Config
+	if d.tlsConfig != nil {
+		config = d.tlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if len(d.pins) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = d.verifyPins
+	}
+	return config
+}
+
+func (d *DNS) verifyPins(state tls.ConnectionState) error {
+	for _, cert := range state.PeerCertificates {
+		pin := SPKIPin(cert)
+		for _, p := range d.pins {
+			if p == pin {
+				return nil
+			}
+		}
+	}
+	return errors.New("no certificate matches the pinned public keys")
+}
+
+// dialTLS 建立 tcp 连接之后握手, 连接和握手的耗时记录在 timing
+func (d *DNS) dialTLS(ctx context.Context, nameserver string, timeout time.Duration, timing *Timing) (*dns.Conn, *tls.ConnectionState, error) {
+	host, _, err := net.SplitHostPort(nameserver)
+	if err != nil {
+		return nil, nil, &Error{Kind: ErrorNetwork, Err: err}
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", nameserver)
+	if err != nil {
+		return nil, nil, transportErr(ctx, err)
+	}
+	handshakeStart := time.Now()
+	timing.Connection = handshakeStart.Sub(start)
+	tc := tls.Client(conn, d.newTLSConfig(host))
+	tc.SetDeadline(deadline)
+	err = tc.Handshake()
+	timing.TLSHandshake = time.Since(handshakeStart)
+	if err != nil {
+		tc.Close()
+		return nil, nil, tlsErr(ctx, err)
+	}
+	state := tc.ConnectionState()
+	return &dns.Conn{Conn: tc}, &state, nil
+}
+
+// tlsErr 握手超时和连接断开是传输的错误, 其它的是 ErrorTLS
+func tlsErr(ctx context.Context, err error) error {
+	var ne net.Error
+	if ctx.Err() != nil || (errors.As(err, &ne) && ne.Timeout()) || errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+		return transportErr(ctx, err)
+	}
+	return &Error{Kind: ErrorTLS, Err: fmt.Errorf("tls handshake: %w", err)}
+}
@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/miekg/dns"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// answerHandler 所有的 A 查询都返回 192.0.2.1
+var answerHandler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if q := req.Question[0]; q.Qtype == dns.TypeA {
+		rr, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+})
+
+// testCert httptest 的证书, 包含 127.0.0.1, ::1 和 example.com
+func testCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	srv := httptest.NewTLSServer(nil)
+	srv.Close()
+	return srv.TLS.Certificates[0], srv.Certificate()
+}
+
+// startTLSServer 在 127.0.0.1 的随机端口启动 DoT 服务器
+func startTLSServer(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Net: "tcp-tls", Handler: answerHandler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return l.Addr().String()
+}
+
+func errorKind(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return 0
+}
+
+func TestDoT(t *testing.T) {
+	cert, leaf := testCert(t)
+	addr := startTLSServer(t, cert)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	pin := SPKIPin(leaf)
+	tests := []struct {
+		name string
+		opts []Option
+		kind ErrorKind // 0 表示成功
+		err  string
+	}{
+		{"sni", []Option{TLSOption(&tls.Config{RootCAs: pool, ServerName: "example.com"})}, 0, ""},
+		{"ip", []Option{TLSOption(&tls.Config{RootCAs: pool})}, 0, ""},
+		{"network", []Option{NetworkOption("tcp-tls"), PinOption(pin)}, 0, ""},
+		{"wrong sni", []Option{TLSOption(&tls.Config{RootCAs: pool, ServerName: "wrong.example"})}, ErrorTLS, "wrong.example"},
+		{"untrusted", []Option{TLSOption(nil)}, ErrorTLS, "unknown authority"},
+		{"pin", []Option{TLSOption(nil), PinOption(pin)}, 0, ""},
+		{"one of pins", []Option{TLSOption(nil), PinOption(strings.Repeat("A", 43)+"=", pin)}, 0, ""},
+		{"pin ignores sni", []Option{TLSOption(&tls.Config{ServerName: "wrong.example"}), PinOption(pin)}, 0, ""},
+		{"pin mismatch", []Option{TLSOption(&tls.Config{RootCAs: pool}), PinOption(strings.Repeat("A", 43) + "=")}, ErrorTLS, "pinned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewDNS(addr, tt.opts...).Query("www.example.com", TypeA)
+			if tt.kind != 0 {
+				if errorKind(err) != tt.kind || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %v %q", err, tt.kind, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Strings(TypeA); len(got) != 1 || got[0] != "192.0.2.1" {
+				t.Fatalf("answer = %v", got)
+			}
+			if r.TLS == nil || !r.TLS.HandshakeComplete {
+				t.Fatalf("TLS = %v", r.TLS)
+			}
+			if r.Timing.TLSHandshake <= 0 || r.Timing.Connection <= 0 {
+				t.Fatalf("Timing = %+v", r.Timing)
+			}
+		})
+	}
+}
+
+func TestSPKIPin(t *testing.T) {
+	_, leaf := testCert(t)
+	pin := SPKIPin(leaf)
+	// base64 的 sha256
+	if len(pin) != 44 || !strings.HasSuffix(pin, "=") {
+		t.Fatalf("SPKIPin = %q", pin)
+	}
+	d := NewDNS("127.0.0.1", PinOption(pin))
+	if err := d.verifyPins(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.verifyPins(tls.ConnectionState{}); err == nil {
+		t.Fatal("verifyPins without certificates = nil")
+	}
+}
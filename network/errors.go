@@ -6,4 +6,5 @@ var (
 	ErrAlreadyRunning = errors.New("already running")
 	ErrAlreadyClosed  = errors.New("already closed")
 	ErrNotRunning     = errors.New("not running")
+	ErrNotFound       = errors.New("not found")
 )
\ No newline at end of file
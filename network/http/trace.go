@@ -3,6 +3,7 @@ package http
 import (
 	"context"
 	"crypto/tls"
+	"github.com/neo-hu/network-probe-tool/network"
 	"io"
 	"io/ioutil"
 	"net"
@@ -22,7 +23,9 @@ type Trace struct {
 	maxBody               int64
 
 	tlsClientConfig *tls.Config
+	resolver        network.Resolver
 	client          *http.Client
+	trace           *httptrace.ClientTrace
 
 	//1.GetConn
 	hostPort string
@@ -83,6 +86,13 @@ func TLSHandshakeTimeoutOption(tlsHandshakeTimeout time.Duration) Option {
 	}
 }
 
+// ResolverOption 解析域名使用的 Resolver, 例如 dns.NewDNS("8.8.8.8"), 默认使用 http.Transport 自己的解析
+func ResolverOption(r network.Resolver) Option {
+	return func(m *Trace) {
+		m.resolver = r
+	}
+}
+
 func CheckRedirectOption(f CheckRedirectFunc) Option {
 	return func(m *Trace) {
 		m.checkRedirect = f
@@ -107,6 +117,7 @@ func NewTrace(ctx context.Context, req *http.Request, opts ...Option) (*Trace, e
 		GotConn:              t.gotConn,
 		GotFirstResponseByte: t.gotFirstResponseByte,
 	}
+	t.trace = trace
 	t.req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
 	for _, opt := range opts {
 		opt(t)
@@ -116,6 +127,9 @@ func NewTrace(ctx context.Context, req *http.Request, opts ...Option) (*Trace, e
 		TLSHandshakeTimeout:   t.tlsHandshakeTimeout,
 		ExpectContinueTimeout: t.expectContinueTimeout,
 	}
+	if t.resolver != nil {
+		tr.DialContext = t.dialContext
+	}
 	switch req.URL.Scheme {
 	case "https":
 		if t.tlsClientConfig == nil {
@@ -146,6 +160,7 @@ func NewTrace(ctx context.Context, req *http.Request, opts ...Option) (*Trace, e
 }
 
 func (t *Trace) Start() (Result, error) {
+	defer t.client.CloseIdleConnections()
 	resp, err := t.client.Do(t.req)
 	r := Result{
 		Addr:             t.connectAddr,
@@ -157,8 +172,12 @@ func (t *Trace) Start() (Result, error) {
 		r.Total = time.Now().Sub(t.dnsStartTime)
 	}
 	if err != nil {
+		if t.isTLS {
+			r.TLSHandshake = t.tlsHandshakeElapsed
+		}
 		return r, err
 	}
+	defer resp.Body.Close()
 	r.Status = resp.StatusCode
 	r.Proto = resp.Proto
 	r.Header = resp.Header
@@ -173,6 +192,12 @@ func (t *Trace) Start() (Result, error) {
 	return r, err
 }
 
+// StartContext 使用 ctx 代替 NewTrace 时候的 context, ctx 取消的时候返回已经完成的阶段耗时
+func (t *Trace) StartContext(ctx context.Context) (Result, error) {
+	t.req = t.req.WithContext(httptrace.WithClientTrace(ctx, t.trace))
+	return t.Start()
+}
+
 func isRedirect(resp *http.Response) bool {
 	return resp.StatusCode > 299 && resp.StatusCode < 400
 }
@@ -194,6 +219,32 @@ func readResponseBody(resp *http.Response, max int64) (int64, error) {
 	return length, err
 }
 
+// dialContext 通过 t.resolver 解析域名, 解析的耗时同样记录在 DNSLookup
+func (t *Trace) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	t.dnsStart(httptrace.DNSStartInfo{Host: host})
+	addrs, err := t.resolver.LookupIPAddr(ctx, host)
+	t.dnsDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, a := range addrs {
+		// 依次尝试所有的地址, 返回最后一个错误
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(a.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
 func (t *Trace) getConn(hostPort string) {
 	t.hostPort = hostPort
 }
@@ -0,0 +1,197 @@
+package mtr
+
+import (
+	"context"
+	"fmt"
+	"github.com/neo-hu/network-probe-tool/network/dns"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ASN ip 所属的自治系统
+type ASN struct {
+	Number   int
+	Prefix   *net.IPNet // 公告的前缀
+	Country  string
+	Registry string
+	Name     string // as 名称, 查询不到的时候为空
+}
+
+func (a *ASN) String() string {
+	if a.Name != "" {
+		return fmt.Sprintf("AS%d %s", a.Number, a.Name)
+	}
+	return fmt.Sprintf("AS%d", a.Number)
+}
+
+// ASNProvider 查询 ip 所属的 ASN, 例如 CymruProvider, 也可以是本地的 MMDB 文件
+type ASNProvider interface {
+	LookupASN(ctx context.Context, ip net.IP) (*ASN, error)
+}
+
+// ReverseDNSOption 通过 d 查询每一跳的 PTR, 结果在 HostStats.Name
+func ReverseDNSOption(d *dns.DNS) Option {
+	return func(m *Mtr) {
+		m.enricher().dns = d
+	}
+}
+
+// ASNOption 查询每一跳的 ASN, 结果在 HostStats.ASN
+func ASNOption(p ASNProvider) Option {
+	return func(m *Mtr) {
+		m.enricher().asn = p
+	}
+}
+
+func (m *Mtr) enricher() *enricher {
+	if m.enrich == nil {
+		m.enrich = &enricher{hosts: map[string]*hostInfo{}}
+	}
+	return m.enrich
+}
+
+type hostInfo struct {
+	name string
+	asn  *ASN
+}
+
+// enricher 在后台查询, 不阻塞发包, 同一个 ip 只查询一次
+type enricher struct {
+	dns *dns.DNS
+	asn ASNProvider
+	ctx context.Context
+
+	mu    sync.Mutex
+	hosts map[string]*hostInfo
+	wg    sync.WaitGroup
+}
+
+// apply 填充已经查询到的结果, 没有查询过的 ip 开始查询
+func (e *enricher) apply(result *Result) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range result.TTL {
+		for j := range result.TTL[i].Hosts {
+			host := &result.TTL[i].Hosts[j]
+			key := host.IP.String()
+			info, ok := e.hosts[key]
+			if !ok {
+				info = &hostInfo{}
+				e.hosts[key] = info
+				e.wg.Add(1)
+				go e.lookup(host.IP, info)
+				continue
+			}
+			host.Name, host.ASN = info.name, info.asn
+		}
+	}
+}
+
+func (e *enricher) lookup(ip net.IP, info *hostInfo) {
+	defer e.wg.Done()
+	var name string
+	var asn *ASN
+	if e.dns != nil {
+		if addr, err := dns.ReverseAddr(ip); err == nil {
+			if _, names, err := e.dns.ExchangeContext(e.ctx, addr, dns.TypePTR); err == nil && len(names) > 0 {
+				name = strings.TrimSuffix(names[0], ".")
+			}
+		}
+	}
+	if e.asn != nil {
+		asn, _ = e.asn.LookupASN(e.ctx, ip)
+	}
+	e.mu.Lock()
+	info.name, info.asn = name, asn
+	e.mu.Unlock()
+}
+
+// wait 等待所有的查询结束
+func (e *enricher) wait() {
+	e.wg.Wait()
+}
+
+// CymruProvider 通过 Team Cymru 的 DNS TXT 记录查询 ASN
+// https://team-cymru.com/community-services/ip-asn-mapping/
+type CymruProvider struct {
+	dns *dns.DNS
+
+	mu    sync.Mutex
+	names map[int]string
+}
+
+func NewCymruProvider(d *dns.DNS) *CymruProvider {
+	return &CymruProvider{dns: d, names: map[int]string{}}
+}
+
+// LookupASN 例如 1.0.0.127.origin.asn.cymru.com 返回 "23028 | 216.90.108.0/24 | US | arin | 1998-09-25"
+func (c *CymruProvider) LookupASN(ctx context.Context, ip net.IP) (*ASN, error) {
+	addr, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		addr = strings.TrimSuffix(addr, "in-addr.arpa.") + "origin.asn.cymru.com"
+	} else {
+		addr = strings.TrimSuffix(addr, "ip6.arpa.") + "origin6.asn.cymru.com"
+	}
+	_, txt, err := c.dns.ExchangeContext(ctx, addr, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if len(txt) == 0 {
+		return nil, fmt.Errorf("no asn for %s", ip)
+	}
+	fields := splitCymru(txt[0])
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("unexpected cymru record %q", txt[0])
+	}
+	// 多个 as 公告同一个前缀的时候, 第一个字段是空格分隔的多个 as
+	numbers := strings.Fields(fields[0])
+	if len(numbers) == 0 {
+		return nil, fmt.Errorf("unexpected cymru record %q", txt[0])
+	}
+	number, err := strconv.Atoi(numbers[0])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected cymru record %q", txt[0])
+	}
+	asn := &ASN{Number: number, Country: fields[2], Registry: fields[3]}
+	if _, prefix, err := net.ParseCIDR(fields[1]); err == nil {
+		asn.Prefix = prefix
+	}
+	asn.Name = c.lookupName(ctx, number)
+	return asn, nil
+}
+
+// lookupName 例如 AS23028.asn.cymru.com 返回 "23028 | US | arin | 2002-01-04 | TEAMCYMRU - SAUNET, US"
+func (c *CymruProvider) lookupName(ctx context.Context, number int) string {
+	c.mu.Lock()
+	name, ok := c.names[number]
+	c.mu.Unlock()
+	if ok {
+		return name
+	}
+	_, txt, err := c.dns.ExchangeContext(ctx, fmt.Sprintf("AS%d.asn.cymru.com", number), dns.TypeTXT)
+	if err != nil {
+		return ""
+	}
+	if len(txt) > 0 {
+		if fields := splitCymru(txt[0]); len(fields) >= 5 {
+			name = fields[4]
+		}
+	}
+	c.mu.Lock()
+	c.names[number] = name
+	c.mu.Unlock()
+	return name
+}
+
+func splitCymru(s string) []string {
+	fields := strings.Split(s, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
@@ -0,0 +1,78 @@
+package mtr
+
+import (
+	"context"
+	mdns "github.com/miekg/dns"
+	"github.com/neo-hu/network-probe-tool/network/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startCymru 在 127.0.0.1 启动返回固定 TXT 记录的服务器, AS 名称的查询返回 name
+func startCymru(t *testing.T, origin, name string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := mdns.HandlerFunc(func(w mdns.ResponseWriter, req *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		txt := origin
+		if strings.HasPrefix(q.Name, "AS") {
+			txt = name
+		}
+		m.Answer = append(m.Answer, &mdns.TXT{
+			Hdr: mdns.RR_Header{Name: q.Name, Rrtype: mdns.TypeTXT, Class: mdns.ClassINET, Ttl: 300},
+			Txt: []string{txt},
+		})
+		w.WriteMsg(m)
+	})
+	started := make(chan struct{})
+	server := &mdns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestCymruLookupASN(t *testing.T) {
+	name := "23028 | US | arin | 2002-01-04 | TEAMCYMRU - SAUNET, US"
+	tests := []struct {
+		name   string
+		origin string
+		number int // 0 表示返回错误
+		prefix string
+	}{
+		{"single", "23028 | 216.90.108.0/24 | US | arin | 1998-09-25", 23028, "216.90.108.0/24"},
+		{"multiple origins", "23028 64512 | 216.90.108.0/24 | US | arin | 1998-09-25", 23028, "216.90.108.0/24"},
+		{"bad prefix", "23028 | - | US | arin | 1998-09-25", 23028, ""},
+		{"empty asn", " | 1.2.3.0/24 | US | arin | 1998-09-25", 0, ""},
+		{"blank asn", "   \t | 1.2.3.0/24 | US | arin | 1998-09-25", 0, ""},
+		{"not a number", "AS23028 | 1.2.3.0/24 | US | arin | 1998-09-25", 0, ""},
+		{"short", "23028 | 1.2.3.0/24", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCymruProvider(dns.NewDNS(startCymru(t, tt.origin, name)))
+			asn, err := c.LookupASN(context.Background(), net.ParseIP("216.90.108.1"))
+			if tt.number == 0 {
+				if err == nil || !strings.Contains(err.Error(), "unexpected cymru record") {
+					t.Fatalf("err = %v, want unexpected cymru record", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if asn.Number != tt.number || asn.Country != "US" || asn.Registry != "arin" || asn.Name != "TEAMCYMRU - SAUNET, US" {
+				t.Fatalf("asn = %+v", asn)
+			}
+			if (tt.prefix == "") != (asn.Prefix == nil) || (asn.Prefix != nil && asn.Prefix.String() != tt.prefix) {
+				t.Fatalf("prefix = %v, want %q", asn.Prefix, tt.prefix)
+			}
+		})
+	}
+}
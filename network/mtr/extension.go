@@ -0,0 +1,93 @@
+package mtr
+
+import (
+	"fmt"
+	"golang.org/x/net/icmp"
+	"net"
+)
+
+// MPLSLabel RFC 4950, 路由器在 Time Exceeded 中带上收到的包的 MPLS 标签栈
+type MPLSLabel struct {
+	Label int
+	TC    int  // traffic class
+	S     bool // 栈底
+	TTL   int
+}
+
+func (l MPLSLabel) String() string {
+	return fmt.Sprintf("L=%d,TC=%d,S=%v,TTL=%d", l.Label, l.TC, l.S, l.TTL)
+}
+
+type InterfaceRole int
+
+const (
+	InterfaceIncoming InterfaceRole = iota // 收到原始报文的接口
+	InterfaceSubIP                         // 收到原始报文的接口的下层接口
+	InterfaceOutgoing                      // 原始报文将要发出的接口
+	InterfaceNextHop                       // 原始报文的下一跳
+)
+
+func (r InterfaceRole) String() string {
+	switch r {
+	case InterfaceIncoming:
+		return "incoming"
+	case InterfaceSubIP:
+		return "sub-ip"
+	case InterfaceOutgoing:
+		return "outgoing"
+	case InterfaceNextHop:
+		return "next-hop"
+	}
+	return fmt.Sprintf("InterfaceRole(%d)", int(r))
+}
+
+// InterfaceInfo RFC 5837, 路由器的接口信息, 没有的字段为零值
+type InterfaceInfo struct {
+	Role  InterfaceRole
+	Index int
+	Name  string
+	MTU   int
+	IP    net.IP
+}
+
+func (i InterfaceInfo) String() string {
+	s := i.Role.String()
+	if i.Name != "" {
+		s += " " + i.Name
+	}
+	if i.Index > 0 {
+		s += fmt.Sprintf(" index=%d", i.Index)
+	}
+	if i.IP != nil {
+		s += " " + i.IP.String()
+	}
+	if i.MTU > 0 {
+		s += fmt.Sprintf(" mtu=%d", i.MTU)
+	}
+	return s
+}
+
+// parseExtensions 转换 icmp 多部分报文 (RFC 4884) 的扩展对象
+func parseExtensions(exts []icmp.Extension) (labels []MPLSLabel, interfaces []InterfaceInfo) {
+	for _, ext := range exts {
+		switch ext := ext.(type) {
+		case *icmp.MPLSLabelStack:
+			for _, l := range ext.Labels {
+				labels = append(labels, MPLSLabel{Label: l.Label, TC: l.TC, S: l.S, TTL: l.TTL})
+			}
+		case *icmp.InterfaceInfo:
+			// c-type 的高 2 位是 role
+			info := InterfaceInfo{Role: InterfaceRole(ext.Type >> 6 & 0x3)}
+			if ext.Interface != nil {
+				info.Index = ext.Interface.Index
+				info.Name = ext.Interface.Name
+				info.MTU = ext.Interface.MTU
+			}
+			if ext.Addr != nil {
+				info.IP = ext.Addr.IP
+			}
+			interfaces = append(interfaces, info)
+		}
+	}
+	return
+}
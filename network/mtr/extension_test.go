@@ -0,0 +1,92 @@
+package mtr
+
+import (
+	"encoding/binary"
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"golang.org/x/net/icmp"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// udpQuote 被引用的 udp 探测包, ipv4 头 + udp 头
+var udpQuote = []byte{
+	0x45, 0x00, 0x00, 0x24, 0x12, 0x34, 0x00, 0x00, 0x01, 0x11, 0x00, 0x00, // ttl 1, udp
+	192, 0, 2, 1, // src
+	198, 51, 100, 7, // dst
+	0x9c, 0x40, 0x82, 0xa1, 0x00, 0x10, 0x00, 0x00, // 40000 -> 33441
+}
+
+// extensionObjects RFC 4884 扩展头和对象
+var extensionObjects = []byte{
+	0x20, 0x00, 0x00, 0x00, // version 2, 校验和 (x/net 不检查)
+	// RFC 4950 MPLS 标签栈, class 1 c-type 1
+	0x00, 0x0c, 0x01, 0x01,
+	0x03, 0xe8, 0x02, 0xfe, // label 16000, TC 1, S 0, TTL 254
+	0x00, 0x01, 0x01, 0x01, // label 16, TC 0, S 1, TTL 1
+	// RFC 5837 接口信息, class 2, incoming, ifIndex + ipaddr + name + mtu
+	0x00, 0x20, 0x02, 0x0f,
+	0x00, 0x00, 0x00, 0x07, // ifIndex
+	0x00, 0x01, 0x00, 0x00, 10, 0, 0, 1, // afi ipv4
+	0x0c, 'g', 'e', '-', '0', '/', '0', '/', '1', 0x00, 0x00, 0x00, // name, 长度包括自己, 4 字节对齐
+	0x00, 0x00, 0x05, 0xdc, // mtu 1500
+	// 接口信息, outgoing (role 2), 只有 ifIndex
+	0x00, 0x08, 0x02, 0x88,
+	0x00, 0x00, 0x00, 0x09,
+}
+
+// timeExceeded icmpv4 Time Exceeded, 原始报文填充到 128 字节 (length = 32)
+func timeExceeded(quote []byte, exts []byte) []byte {
+	b := []byte{11, 0, 0, 0, 0, 0, 0, 0}
+	data := quote
+	if exts != nil {
+		b[5] = 32
+		data = make([]byte, 128)
+		copy(data, quote)
+	}
+	b = append(append(b, data...), exts...)
+	binary.BigEndian.PutUint16(b[2:], foldChecksum(checksum(0, b)))
+	return b
+}
+
+func TestParseExtensions(t *testing.T) {
+	m := &Mtr{mode: icmp2.IPV4Address, protocol: ProtocolUDP, ip: net.ParseIP("198.51.100.7"), srcPort: 40000, port: 33434}
+	tests := []struct {
+		name       string
+		b          []byte
+		labels     []MPLSLabel
+		interfaces []InterfaceInfo
+	}{
+		{"no extension", timeExceeded(udpQuote, nil), nil, nil},
+		{
+			"mpls and interface", timeExceeded(udpQuote, extensionObjects),
+			[]MPLSLabel{{Label: 16000, TC: 1, TTL: 254}, {Label: 16, S: true, TTL: 1}},
+			[]InterfaceInfo{
+				{Role: InterfaceIncoming, Index: 7, Name: "ge-0/0/1", MTU: 1500, IP: net.IPv4(10, 0, 0, 1).To4()},
+				{Role: InterfaceOutgoing, Index: 9},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := icmp.ParseMessage(1, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, ok := msg.Body.(*icmp.TimeExceeded)
+			if !ok {
+				t.Fatalf("body = %T", msg.Body)
+			}
+			if _, seq, ok := m.parseQuote(body.Data); !ok || seq != 7 {
+				t.Fatalf("parseQuote = %d, %v, want 7", seq, ok)
+			}
+			labels, interfaces := parseExtensions(body.Extensions)
+			if !reflect.DeepEqual(labels, tt.labels) {
+				t.Fatalf("labels = %v, want %v", labels, tt.labels)
+			}
+			if !reflect.DeepEqual(interfaces, tt.interfaces) {
+				t.Fatalf("interfaces = %v, want %v", interfaces, tt.interfaces)
+			}
+		})
+	}
+}
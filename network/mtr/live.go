@@ -0,0 +1,102 @@
+package mtr
+
+import (
+	"time"
+)
+
+const (
+	DefaultRoundInterval = time.Second
+	DefaultHistory       = 100
+)
+
+// RoundHandler 每一轮的探测包全部回复或者超时之后调用, result 是当前所有保留的轮次的结果
+type RoundHandler func(round int, result *Result)
+
+// ContinuousOption 一直运行, 直到 Stop 或者 ctx 取消, 忽略 CountOption
+func ContinuousOption() Option {
+	return func(m *Mtr) {
+		m.continuous = true
+	}
+}
+
+// DurationOption 运行 d 之后停止发送, 忽略 CountOption
+func DurationOption(d time.Duration) Option {
+	return func(m *Mtr) {
+		m.duration = d
+	}
+}
+
+// RoundIntervalOption 每一轮开始的最小间隔, 持续运行的时候默认 DefaultRoundInterval
+func RoundIntervalOption(d time.Duration) Option {
+	return func(m *Mtr) {
+		m.roundInterval = d
+	}
+}
+
+// HistoryOption 只保留最近 n 轮的结果, 持续运行的时候默认 DefaultHistory, n <= 0 表示全部保留
+func HistoryOption(n int) Option {
+	return func(m *Mtr) {
+		if n <= 0 {
+			// 0 是没有设置, 会被替换成 DefaultHistory
+			n = -1
+		}
+		m.history = n
+	}
+}
+
+// RoundHandlerOption 每一轮结束之后回调, 在 Start 的 goroutine 中调用, 不能阻塞太久
+func RoundHandlerOption(handler RoundHandler) Option {
+	return func(m *Mtr) {
+		m.roundHandler = handler
+	}
+}
+
+// live 是否按时间运行, 而不是固定的轮数
+func (m *Mtr) live() bool {
+	return m.continuous || m.duration > 0
+}
+
+// report 按顺序回调已经结束的轮次
+func (m *Mtr) report() {
+	for m.reported < m.currentCount && m.pending[m.reported] == 0 {
+		delete(m.pending, m.reported)
+		if m.roundHandler != nil {
+			result := m.buildResult(m.reported)
+			if m.enrich != nil {
+				// 只填充已经查询到的结果
+				m.enrich.apply(result)
+			}
+			m.roundHandler(m.reported, result)
+		}
+		m.reported += 1
+	}
+}
+
+// prune 删除 history 之前的轮次, 避免持续运行的时候内存一直增长
+func (m *Mtr) prune() {
+	if m.history <= 0 {
+		return
+	}
+	before := m.reported - m.history
+	for round := range m.pingTTL {
+		if round < before {
+			delete(m.pingTTL, round)
+		}
+	}
+	for _, r := range m.result {
+		if r == nil {
+			continue
+		}
+		i := 0
+		for i < len(r.entries) && r.entries[i].round < before {
+			if len(r.entries[i].ip) != 0 {
+				r.reply -= 1
+			}
+			i++
+		}
+		if i > 0 {
+			r.entries = append(r.entries[:0:0], r.entries[i:]...)
+			r.base += i
+		}
+	}
+}
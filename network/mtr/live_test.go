@@ -0,0 +1,79 @@
+package mtr
+
+import (
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestMtr 没有 socket, 发送会失败, 回复通过 timeExceeded 和 echoReply 模拟
+func newTestMtr(t *testing.T, opts ...Option) *Mtr {
+	m, err := newMtr("127.0.0.1", append([]Option{MaxTTLOption(2)}, opts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.seqPool = icmp2.NewSeqPool(uint16(m.ident))
+	m.ev = &evQueue{}
+	m.sendFd = -1
+	return m
+}
+
+// runRounds 每一轮第 1 跳 Time Exceeded, 第 2 跳到达目的地址
+func runRounds(m *Mtr, rounds int) {
+	hop := net.ParseIP("10.0.0.1")
+	for i := 0; i < rounds; i++ {
+		m.step(time.Now())
+		m.timeExceeded(hop, m.ev.first.ident, m.ev.first.seq, nil)
+		m.step(time.Now())
+		m.echoReply(m.ip, m.ev.first.ident, m.ev.first.seq)
+	}
+	m.prune()
+}
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		history int
+		rounds  int
+		want    int // 保留的轮数
+	}{
+		{"count", nil, 0, 5, 5},
+		{"live default", []Option{ContinuousOption()}, DefaultHistory, DefaultHistory + 20, DefaultHistory},
+		{"live limit", []Option{ContinuousOption(), HistoryOption(3)}, 3, 10, 3},
+		{"live keep all", []Option{ContinuousOption(), HistoryOption(0)}, -1, DefaultHistory + 20, DefaultHistory + 20},
+		{"live negative", []Option{ContinuousOption(), HistoryOption(-5)}, -1, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMtr(t, tt.opts...)
+			if m.history != tt.history {
+				t.Fatalf("history = %d, want %d", m.history, tt.history)
+			}
+			var rounds []int
+			m.roundHandler = func(round int, result *Result) {
+				rounds = append(rounds, round)
+			}
+			runRounds(m, tt.rounds)
+			if len(rounds) != tt.rounds || rounds[len(rounds)-1] != tt.rounds-1 {
+				t.Fatalf("reported rounds = %v, want %d", rounds, tt.rounds)
+			}
+			result := m.buildResult(-1)
+			if len(result.TTL) != 2 {
+				t.Fatalf("ttl = %d, want 2", len(result.TTL))
+			}
+			for i, tr := range result.TTL {
+				if tr.Sent != tt.want || tr.Received != tt.want {
+					t.Fatalf("ttl %d: sent/received = %d/%d, want %d", i+1, tr.Sent, tr.Received, tt.want)
+				}
+				if r := m.result[i+1]; r.reply != tt.want || r.base != tt.rounds-tt.want {
+					t.Fatalf("ttl %d: reply = %d, base = %d, want %d, %d", i+1, r.reply, r.base, tt.want, tt.rounds-tt.want)
+				}
+			}
+			if len(m.pingTTL) != tt.want {
+				t.Fatalf("pingTTL = %d rounds, want %d", len(m.pingTTL), tt.want)
+			}
+		})
+	}
+}
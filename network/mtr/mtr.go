@@ -1,6 +1,7 @@
 package mtr
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -22,7 +23,11 @@ import (
 
 type seqValue struct {
 	ttl   int // 第几跳
-	index int // count index
+	index int // 在 seqResult 中的位置
+	round int // 第几轮
+	ident uint16
+	seq   uint16
+	m     *Mtr // 所属的目标, Tracer 中多个目标共享 seqPool
 
 	evPrev *seqValue /* double linked list for the event-queue */
 	evNext *seqValue /* double linked list for the event-queue */
@@ -30,20 +35,49 @@ type seqValue struct {
 }
 
 type Mtr struct {
-	socketFd int
-	s        *_select.Select
-	target   string
-	sa       syscall.Sockaddr
-	ip       net.IP
-	localIp  net.IP
+	socketFd   int // 接收 icmp 差错报文
+	sendFd     int // 发送探测包, icmp 探测时同 socketFd
+	reserveFd  int // tcp 探测时占用源端口
+	errQueueFd int // 从 MSG_ERRQUEUE 读取差错报文的 socket
+	s          *_select.Select
+	target     string
+	sa         syscall.Sockaddr
+	ip         net.IP
+	localIp    net.IP
+
+	resolver    network.Resolver
+	resolveTime time.Duration // 解析 target 的耗时
 
 	mode         icmp2.Mode
+	socketType   icmp2.SocketType
+	protocol     Protocol
+	port         int // udp 起始的目的端口 or tcp 目的端口
+	srcPort      int
+	paris        bool
+	multipath    float64 // 多路径探测的置信度
+	nextFlow     int
+	graph        *Graph
+	enrich       *enricher
 	currentCount int
 	currentTTL   int
 
+	continuous    bool
+	duration      time.Duration
+	roundInterval time.Duration // 每一轮开始的最小间隔
+	history       int           // 保留最近多少轮的结果, 小于 0 的时候全部保留
+	roundHandler  RoundHandler
+	pending       map[int]int // 每一轮还没有回复或者超时的探测包数量
+	reported      int         // 下一个回调的轮次
+
 	pingTTL       map[int]int // 如果已经到达对端，当前ping循环不用不用继续发送ttl
 	currentMaxTTL int
 
+	lastSendTime time.Time
+	roundTime    time.Time // 当前这一轮开始的时间
+	deadline     time.Time // DurationOption 的结束时间
+	sendAt       time.Time // Tracer 中下一个探测包的发送时间
+	index        int       // 在 TargetHeap 中的位置
+
 	seqPool *icmp2.SeqPool
 
 	forceIPv4, forceIPv6 bool
@@ -54,9 +88,8 @@ type Mtr struct {
 	timeout              time.Duration //  超时时间 , default 1 Second
 	dataSize             int           //  发包的大小 , default 64
 
-	evFirst *seqValue
-	evLast  *seqValue
-	buffer  []byte
+	ev     *evQueue // 超时队列, Tracer 中所有目标共享
+	buffer []byte
 
 	result []*seqResult
 
@@ -65,9 +98,23 @@ type Mtr struct {
 }
 
 func NewMtr(target string, opts ...Option) (*Mtr, error) {
-	m := &Mtr{
-		s:          _select.NewSelect(),
-		target:     target,
+	m, err := newMtr(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	m.s = _select.NewSelect()
+	m.seqPool = icmp2.NewSeqPool(uint16(m.ident))
+	m.ev = &evQueue{}
+	if err = m.listen(); err != nil {
+		m.close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// defaultMtr 默认的配置, 还没有 socket
+func defaultMtr() *Mtr {
+	return &Mtr{
 		ident:      os.Getpid() & 0xFFFF,
 		interval:   icmp2.DefaultInterval,
 		maxTTL:     60,
@@ -75,16 +122,35 @@ func NewMtr(target string, opts ...Option) (*Mtr, error) {
 		count:      3,
 		timeout:    icmp2.DefaultTimeout,
 		pingTTL:    map[int]int{},
+		pending:    map[int]int{},
 		currentTTL: 1,
 		buffer:     make([]byte, 4096),
+		index:      -1,
 	}
+}
+
+// newMtr 解析目标地址, 还没有 socket
+func newMtr(target string, opts []Option) (*Mtr, error) {
+	m := defaultMtr()
+	m.target = target
 	for _, opt := range opts {
 		opt(m)
 	}
-	m.seqPool = icmp2.NewSeqPool(uint16(m.ident))
-	ips, err := net.LookupIP(target)
-
-	for _, ip := range ips {
+	if m.live() {
+		if m.roundInterval == 0 {
+			m.roundInterval = DefaultRoundInterval
+		}
+		if m.history == 0 {
+			m.history = DefaultHistory
+		}
+	}
+	addrs, resolveTime, err := network.LookupIPAddr(context.Background(), m.resolver, target)
+	if err != nil {
+		return nil, err
+	}
+	m.resolveTime = resolveTime
+	for _, addr := range addrs {
+		ip := addr.IP
 		m.ip = ip
 		if IsIPv4(ip) && !m.forceIPv6 {
 			sa1 := &syscall.SockaddrInet4{}
@@ -103,17 +169,13 @@ func NewMtr(target string, opts ...Option) (*Mtr, error) {
 	if m.sa == nil {
 		return nil, errors.New("there is not A or AAAA record")
 	}
-	m.socketFd, err = icmp2.Listen(m.mode)
-	if err != nil {
-		return nil, err
-	}
-
-	localIp, err := udp.GetLocalAddr(target)
+	localIp, err := udp.GetLocalAddr(m.ip.String())
 	if err == nil {
 		m.localIp = localIp
 	}
-
-	m.s.Add(m.socketFd)
+	if m.localIp == nil && m.needLocalIp() {
+		return nil, errors.New("local ip addr not found")
+	}
 	m.result = make([]*seqResult, m.maxTTL+1, m.maxTTL+1)
 	return m, nil
 }
@@ -163,6 +225,20 @@ func IntervalOption(interval time.Duration) Option {
 	}
 }
 
+// ResolverOption 解析目标使用的 Resolver, 例如 dns.NewDNS("8.8.8.8"), 默认 net.DefaultResolver
+func ResolverOption(r network.Resolver) Option {
+	return func(m *Mtr) {
+		m.resolver = r
+	}
+}
+
+// SocketTypeOption icmp socket 类型, 默认 icmp.SocketRaw
+func SocketTypeOption(t icmp2.SocketType) Option {
+	return func(m *Mtr) {
+		m.socketType = t
+	}
+}
+
 func IsIPv4(ip net.IP) bool {
 	return len(ip.To4()) == net.IPv4len
 }
@@ -175,64 +251,221 @@ func IsIPv6(ip net.IP) bool {
 	return false
 }
 
+// Close 释放 socket, 如果正在运行, 同 Stop 一样由 Start 释放 socket
 func (m *Mtr) Close() error {
+	if atomic.LoadInt32(&m.startingFlag) == 1 {
+		if err := m.Stop(); err != nil && err != network.ErrAlreadyClosed {
+			return err
+		}
+		return nil
+	}
+	return m.close()
+}
+
+func (m *Mtr) close() (err error) {
+	err = m.closeSockets()
+	if cErr := m.s.Close(); cErr != nil {
+		err = cErr
+	}
+	return
+}
+
+// closeSockets 只关闭 socket, Tracer 中 m.s 是共享的
+func (m *Mtr) closeSockets() (err error) {
+	if m.sendFd > 0 && m.sendFd != m.socketFd {
+		err = unix.Close(m.sendFd)
+	}
+	m.sendFd = 0
+	if m.reserveFd > 0 {
+		err = unix.Close(m.reserveFd)
+		m.reserveFd = 0
+	}
 	if m.socketFd > 0 {
-		return unix.Close(m.socketFd)
+		err = unix.Close(m.socketFd)
+		m.socketFd = 0
 	}
+	return
+}
+
+// Stop 可以在其它 goroutine 中调用, Start 会返回已经完成的结果
+func (m *Mtr) Stop() error {
+	if atomic.LoadInt32(&m.startingFlag) != 1 {
+		return network.ErrNotRunning
+	}
+	if !atomic.CompareAndSwapInt32(&m.closeFlag, 0, 1) {
+		return network.ErrAlreadyClosed
+	}
+	m.s.Wakeup()
 	return nil
 }
 
+func (m *Mtr) isClosing() bool {
+	return atomic.LoadInt32(&m.closeFlag) == 1
+}
+
 func (m *Mtr) Start() (*Result, error) {
+	return m.StartContext(context.Background())
+}
+
+// StartContext ctx 取消或者超时的时候停止发包, 返回已经完成的结果和 ctx.Err()
+func (m *Mtr) StartContext(ctx context.Context) (*Result, error) {
 	if atomic.SwapInt32(&m.startingFlag, 1) == 1 {
 		return nil, network.ErrAlreadyRunning
 	}
-	var lastSendTime time.Time
+	defer m.close()
+	if err := m.s.EnableWakeup(); err != nil {
+		return nil, err
+	}
+	if m.enrich != nil {
+		m.enrich.ctx = ctx
+	}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				m.Stop()
+			case <-done:
+			}
+		}()
+	}
+	if m.multipath > 0 {
+		m.discover()
+	} else {
+		m.run()
+	}
+
+	var err error
+	if !atomic.CompareAndSwapInt32(&m.closeFlag, 0, 1) {
+		err = network.ErrAlreadyClosed
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return m.finalResult(), err
+}
+
+// finalResult 所有的结果, 等待 PTR 和 ASN 查询结束
+func (m *Mtr) finalResult() *Result {
+	result := m.buildResult(-1)
+	if m.enrich != nil {
+		m.enrich.apply(result)
+		m.enrich.wait()
+		m.enrich.apply(result)
+	}
+	return result
+}
+
+func (m *Mtr) run() {
 	var waitTime time.Duration
-	for m.count > m.currentCount {
-		ld := time.Now().Sub(lastSendTime)
-		if ld < m.interval {
-			// 前一个包发送的间隔没到
-			waitTime = m.interval - ld
-			goto waitForReply
+	m.begin(time.Now())
+	for !m.isClosing() {
+		now := time.Now()
+		m.expire(now)
+		next, ok := m.nextSend(now)
+		if !ok {
+			break
 		}
-		lastSendTime = time.Now()
-		m.send(lastSendTime)
-		m.currentTTL += 1
-		if _, ok := m.pingTTL[m.currentCount]; ok || m.currentTTL > m.maxTTL {
-			// todo 当前这轮ping已经到达对端了 or 已经到上限，发送下一轮ping
-			m.currentTTL = 1
-			m.currentCount += 1
+		if waitTime = next.Sub(now); waitTime <= 0 {
+			m.step(now)
+			waitTime = m.interval
 		}
-		waitTime = m.interval
-	waitForReply:
-		for {
-			if w, _ := m.waitForReply(waitTime); !w {
-				break
+		if m.ev.first != nil {
+			if d := m.ev.first.evTime.Sub(time.Now()); d < waitTime {
+				waitTime = d
 			}
-			// 如果已经接收到一个数据，继续接收
+		}
+		if waitTime < 0 {
 			waitTime = 0
 		}
+		m.drain(waitTime)
 	}
+	m.finish()
+	m.waitForAll()
+}
 
-	for m.evFirst != nil {
-		waitTime = m.evFirst.evTime.Sub(time.Now())
-		if waitTime < 0 {
-			// todo 接收超时了
-			m.evRemove(m.evFirst)
-			continue
+// begin 开始发包, DurationOption 从这个时候开始计算
+func (m *Mtr) begin(now time.Time) {
+	m.deadline = now.Add(m.duration)
+}
+
+// nextSend 下一个探测包的发送时间, 已经发送完成的时候 ok 为 false
+func (m *Mtr) nextSend(now time.Time) (next time.Time, ok bool) {
+	if m.live() {
+		if m.duration > 0 && !now.Before(m.deadline) {
+			return
 		}
-		for {
-			if w, _ := m.waitForReply(waitTime); !w {
-				break
-			}
-			// 如果已经接收到一个数据，继续接收
-			waitTime = 0
+	} else if m.count <= m.currentCount {
+		return
+	}
+	// 前一个包发送的间隔
+	next = m.lastSendTime.Add(m.interval)
+	if m.currentTTL == 1 {
+		// 新的一轮
+		if t := m.roundTime.Add(m.roundInterval); t.After(next) {
+			next = t
+		}
+	}
+	return next, true
+}
+
+// step 发送当前这一跳的探测包, 然后进入下一跳或者下一轮
+func (m *Mtr) step(now time.Time) {
+	if m.currentTTL == 1 {
+		m.roundTime = now
+	}
+	m.lastSendTime = now
+	// 发送失败的错误记录在 TTLResult.SendErr, 继续下一跳
+	m.send(now)
+	m.currentTTL += 1
+	if _, ok := m.pingTTL[m.currentCount]; ok || m.currentTTL > m.maxTTL {
+		// 当前这轮ping已经到达对端了 or 已经到上限，发送下一轮ping
+		m.currentTTL = 1
+		m.currentCount += 1
+		m.report()
+		m.prune()
+	}
+}
+
+// finish 停止发包, 结束没有发送完的一轮
+func (m *Mtr) finish() {
+	if m.currentTTL > 1 {
+		m.currentTTL = 1
+		m.currentCount += 1
+		m.report()
+	}
+}
+
+// drain 在 waitTime 内接收所有的回复
+func (m *Mtr) drain(waitTime time.Duration) {
+	for !m.isClosing() {
+		if w, _ := m.waitForReply(waitTime); !w {
+			break
+		}
+		// 如果已经接收到一个数据，继续接收
+		waitTime = 0
+	}
+}
+
+// waitForAll 等待所有已经发送的包回复或者超时
+func (m *Mtr) waitForAll() {
+	for m.ev.first != nil && !m.isClosing() {
+		m.expire(time.Now())
+		if m.ev.first != nil {
+			m.drain(m.ev.first.evTime.Sub(time.Now()))
 		}
 	}
+}
 
+// buildResult 只包含 maxRound 之前 (包括) 的轮次, 小于 0 的时候包含所有的轮次
+func (m *Mtr) buildResult(maxRound int) *Result {
 	result := &Result{
-		TargetIp: m.ip,
-		LocalIp:  m.localIp,
+		Target:      m.target,
+		ResolveTime: m.resolveTime,
+		TargetIp:    m.ip,
+		LocalIp:     m.localIp,
+		Graph:       m.graph,
 	}
 
 	//for ttl, r := range m.result {
@@ -245,31 +478,39 @@ func (m *Mtr) Start() (*Result, error) {
 	//	}
 	//	fmt.Println()
 	//}
-	for ttl, r := range m.result[:m.currentMaxTTL+1] {
+	maxTTL := m.currentMaxTTL
+	if maxTTL == 0 {
+		// 没有到达目的地址, 返回所有发送过的跳
+		maxTTL = m.maxTTL
+	}
+	for ttl, r := range m.result[:maxTTL+1] {
 		if ttl == 0 {
 			continue
 		}
 		if r == nil {
 			break
 		}
-		tr := TTLResult{}
-		for i, entry := range r.entries {
-			maxTTL := m.pingTTL[i]
+		var entries []TTLResultEntry
+		for _, entry := range r.entries {
+			if maxRound >= 0 && entry.round > maxRound {
+				break
+			}
+			maxTTL := m.pingTTL[entry.round]
 			if maxTTL > 0 && maxTTL < ttl {
 				continue
 			}
-			e := TTLResultEntry{IP: entry.ip}
+			e := TTLResultEntry{IP: entry.ip, MPLS: entry.mpls, Interfaces: entry.interfaces, Unreachable: entry.unreachable, Err: entry.err}
 			if len(entry.ip) != 0 {
 				e.Elapsed = entry.replyTime.Sub(entry.t)
 			}
-			tr.Entries = append(tr.Entries, e)
+			entries = append(entries, e)
 		}
-		if len(tr.Entries) == 0 {
+		if len(entries) == 0 {
 			break
 		}
-		result.TTL = append(result.TTL, tr)
+		result.TTL = append(result.TTL, newTTLResult(entries))
 	}
-	return result, nil
+	return result
 }
 
 func (m *Mtr) waitForReply(waitTime time.Duration) (bool, error) {
@@ -281,17 +522,41 @@ func (m *Mtr) waitForReply(waitTime time.Duration) (bool, error) {
 		// todo timeout
 		return false, nil
 	}
+	return m.read(s)
+}
+
+// owns fd 是否是 m 的 socket
+func (m *Mtr) owns(fd int) bool {
+	return fd == m.socketFd || fd == m.sendFd || fd == m.errQueueFd
+}
+
+// read 读取一个报文, Tracer 中 m 是共享 socket 的地址族, 回复通过 seqPool 分发给对应的目标
+func (m *Mtr) read(s *_select.Recv) (bool, error) {
+	if s.Fd() == m.errQueueFd && m.readErrQueue(s.Fd()) {
+		return true, nil
+	}
 	n, ra, err := s.Read(m.buffer[:])
+	if err != nil {
+		return false, err
+	}
+	if s.Fd() != m.socketFd {
+		// tcp 探测, 目的地址回复的 syn+ack or rst
+		if m.protocol == ProtocolTCP {
+			m.tcpReply(m.buffer[:n], sockaddrIP(ra))
+		}
+		return true, nil
+	}
 	var proto int
 	var start int
 	var src net.IP
 	switch sockaddr := ra.(type) {
 	case *syscall.SockaddrInet4:
 		proto = ipv4.ICMPType(0).Protocol()
-		src, start = icmp2.StripIPv4Header(m.buffer[:n])
+		_, start = icmp2.StripIPv4Header(m.buffer[:n])
+		src = net.IP(append([]byte(nil), sockaddr.Addr[:]...))
 	case *syscall.SockaddrInet6:
 		proto = ipv6.ICMPType(0).Protocol()
-		src = net.IP(ra.(*syscall.SockaddrInet6).Addr[:])
+		src = net.IP(append([]byte(nil), sockaddr.Addr[:]...))
 	default:
 		return false, fmt.Errorf("%T type err", sockaddr)
 	}
@@ -301,112 +566,210 @@ func (m *Mtr) waitForReply(waitTime time.Duration) (bool, error) {
 	}
 
 	switch msg.Type {
-	case ipv6.ICMPTypeTimeExceeded:
-	case ipv4.ICMPTypeTimeExceeded:
-		// todo ttl 超时
-		// todo StripIPv4Header(len: start) + ParseMessage (len: 4) +  TimeExceeded (len: 4) + 24 + ident (len:2)  + seq (len:2)
-		pos := start + 4 + 4 + 24
-		if n < pos+4 {
-			break
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		if body, ok := msg.Body.(*icmp.TimeExceeded); ok {
+			if ident, seq, ok := m.parseQuote(body.Data); ok {
+				m.timeExceeded(src, ident, seq, body.Extensions)
+			}
 		}
-		v := m.seqPool.Free(binary.BigEndian.Uint16(m.buffer[pos:n]), binary.BigEndian.Uint16(m.buffer[pos+2:n]))
-		if v == nil {
-			// todo 非本程序发送的
-			break
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+		if body, ok := msg.Body.(*icmp.DstUnreach); ok {
+			var mtu int
+			if msg.Type == ipv4.ICMPTypeDestinationUnreachable && n >= start+8 {
+				// frag needed 的时候 icmp 头的最后 2 个字节是下一跳的 mtu
+				mtu = int(binary.BigEndian.Uint16(m.buffer[start+6:]))
+			}
+			if ident, seq, ok := m.parseQuote(body.Data); ok {
+				m.destUnreachable(src, ident, seq, newUnreachable(m.mode, icmpType(msg.Type), msg.Code, mtu), body.Extensions)
+			}
+		}
+	case ipv6.ICMPTypePacketTooBig:
+		if body, ok := msg.Body.(*icmp.PacketTooBig); ok {
+			if ident, seq, ok := m.parseQuote(body.Data); ok {
+				m.destUnreachable(src, ident, seq, newUnreachable(m.mode, icmpType(msg.Type), msg.Code, body.MTU), nil)
+			}
+		}
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+		if pkt, ok := msg.Body.(*icmp.Echo); ok && m.protocol == ProtocolICMP {
+			m.echoReply(src, uint16(pkt.ID), uint16(pkt.Seq))
 		}
-		val := v.(*seqValue)
-		e := m.result[val.ttl].entries[val.index]
+	}
+	return true, nil
+}
+
+func (m *Mtr) free(ident, seq uint16) *seqValue {
+	var v interface{}
+	if m.socketType == icmp2.SocketDgram || m.protocol == ProtocolUDP {
+		// 内核改写了 ident 或者 udp 探测没有 ident, 只能通过 seq 匹配
+		v = m.seqPool.FreeSeq(seq)
+	} else if m.paris && m.protocol == ProtocolICMP {
+		// paris 模式 ident 固定为 m.ident, seq 溢出之后 seqPool 的 ident 会变化, 先检查 ident 再通过 seq 匹配,
+		// raw socket 会收到本机所有的 echo 回复, 不能只通过 seq 匹配
+		if ident != uint16(m.ident) {
+			return nil
+		}
+		v = m.seqPool.FreeSeq(seq)
+	} else {
+		v = m.seqPool.Free(ident, seq)
+	}
+	if v == nil {
+		// todo 非本程序发送的
+		return nil
+	}
+	return v.(*seqValue)
+}
+
+// entry 探测包的结果, 已经被 prune 的时候返回 nil
+func (m *Mtr) entry(val *seqValue) *seqEntry {
+	r := m.result[val.ttl]
+	if val.index < r.base {
+		return nil
+	}
+	return &r.entries[val.index-r.base]
+}
+
+// resolve 探测包收到回复或者超时
+func (m *Mtr) resolve(val *seqValue) {
+	m.ev.remove(val)
+	m.pending[val.round] -= 1
+	m.report()
+}
+
+// timeExceeded exts 为 icmp 扩展对象, 只有 raw socket 可以收到.
+// 这几个回调中 m 只用来匹配探测包, Tracer 中是共享的 socket, 结果记录到探测包所属的目标 val.m
+func (m *Mtr) timeExceeded(src net.IP, ident, seq uint16, exts []icmp.Extension) {
+	val := m.free(ident, seq)
+	if val == nil {
+		return
+	}
+	t := val.m
+	if e := t.entry(val); e != nil {
 		e.ip = src
 		e.replyTime = time.Now()
-		m.result[val.ttl].entries[val.index] = e
+		e.mpls, e.interfaces = parseExtensions(exts)
+		t.result[val.ttl].reply += 1
+	}
+	t.resolve(val)
+}
+
+func (m *Mtr) echoReply(src net.IP, ident, seq uint16) {
+	if val := m.free(ident, seq); val != nil {
+		val.m.reached(val, src)
+	}
+}
+
+// reached 探测包到达目的地址
+func (m *Mtr) reached(val *seqValue, src net.IP) {
+	if e := m.entry(val); e != nil {
+		e.ip = src
+		e.replyTime = time.Now()
+		e.end = true
 		m.result[val.ttl].reply += 1
-		m.evRemove(val)
-	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
-		if pkt, ok := msg.Body.(*icmp.Echo); ok {
-			v := m.seqPool.Free(uint16(pkt.ID), uint16(pkt.Seq))
-			if v == nil {
-				// todo 非本程序发送的
-				break
-			}
-			val := v.(*seqValue)
-			e := m.result[val.ttl].entries[val.index]
-			m.result[val.ttl].reply += 1
-			e.ip = src
-			e.replyTime = time.Now()
-			e.end = true
-			m.result[val.ttl].entries[val.index] = e
-			// todo 已经到目的了
-			m.evRemove(val)
-			if m.pingTTL[val.index] == 0 || m.pingTTL[val.index] > val.ttl {
-				m.pingTTL[val.index] = val.ttl
-				if m.currentMaxTTL == 0 || val.ttl > m.currentMaxTTL {
-					m.currentMaxTTL = val.ttl
-				}
-			}
+	}
+	// 已经到目的了, 这一轮不用继续发送更大的 ttl
+	m.terminate(val)
+	m.resolve(val)
+}
+
+// destUnreachable 路径中断, 或者 udp 探测到达目的地址
+func (m *Mtr) destUnreachable(src net.IP, ident, seq uint16, u *Unreachable, exts []icmp.Extension) {
+	val := m.free(ident, seq)
+	if val == nil {
+		return
+	}
+	t := val.m
+	reached := src.Equal(t.ip)
+	if reached && t.protocol == ProtocolUDP && u.Reason == UnreachablePort {
+		t.reached(val, src)
+		return
+	}
+	if e := t.entry(val); e != nil {
+		e.ip = src
+		e.replyTime = time.Now()
+		e.end = reached
+		e.unreachable = u
+		e.mpls, e.interfaces = parseExtensions(exts)
+		t.result[val.ttl].reply += 1
+	}
+	t.terminate(val)
+	t.resolve(val)
+}
+
+// terminate 这一轮的路径在 val.ttl 终止
+func (m *Mtr) terminate(val *seqValue) {
+	if m.multipath == 0 && (m.pingTTL[val.round] == 0 || m.pingTTL[val.round] > val.ttl) {
+		m.pingTTL[val.round] = val.ttl
+		if m.currentMaxTTL == 0 || val.ttl > m.currentMaxTTL {
+			m.currentMaxTTL = val.ttl
 		}
 	}
-	return true, nil
+}
+
+// expire 释放超时的探测包
+func (m *Mtr) expire(now time.Time) {
+	for m.ev.first != nil && !m.ev.first.evTime.After(now) {
+		val := m.ev.first
+		m.seqPool.Free(val.ident, val.seq)
+		val.m.resolve(val)
+	}
 }
 
 func (m *Mtr) send(lastSendTime time.Time) error {
-	if m.result[m.currentTTL] == nil {
-		m.result[m.currentTTL] = &seqResult{}
+	_, err := m.sendProbe(m.currentTTL, 0, lastSendTime)
+	return err
+}
+
+// sendProbe 发送一个探测包, flow 只在 paris 模式下使用
+func (m *Mtr) sendProbe(ttl int, flow uint16, lastSendTime time.Time) (*seqValue, error) {
+	if m.result[ttl] == nil {
+		m.result[ttl] = &seqResult{}
 	}
+	r := m.result[ttl]
 	sv := &seqValue{
-		ttl:    m.currentTTL,
-		index:  len(m.result[m.currentTTL].entries),
+		ttl:    ttl,
+		index:  r.base + len(r.entries),
+		round:  m.currentCount,
+		m:      m,
 		evTime: lastSendTime.Add(m.timeout),
 	}
-	ident, seq := m.seqPool.Apply(sv)
-	m.result[m.currentTTL].entries = append(m.result[m.currentTTL].entries, seqEntry{
-		t: lastSendTime,
+	sv.ident, sv.seq = m.seqPool.Apply(sv)
+	r.entries = append(r.entries, seqEntry{
+		t:     lastSendTime,
+		round: m.currentCount,
 	})
-	m.evEnqueue(sv)
-	var b []byte
-	var err error
-	if m.dataSize > len(m.buffer) {
-		m.buffer = make([]byte, m.dataSize)
-	}
-	if m.mode == icmp2.IPV4Address {
-		b, err = (&icmp.Message{
-			Type: ipv4.ICMPTypeEcho, Code: 0,
-			Body: &icmp.Echo{
-				ID: int(ident), Seq: int(seq),
-				Data: m.buffer[:m.dataSize],
-			},
-		}).Marshal(nil)
-		if err != nil {
-			return err
-		}
-		err = syscall.SetsockoptInt(m.socketFd, syscall.IPPROTO_IP, syscall.IP_TTL, m.currentTTL)
-		if err != nil {
-			return err
-		}
-	} else {
-		b, err = (&icmp.Message{
-			Type: ipv6.ICMPTypeEchoRequest, Code: 0,
-			Body: &icmp.Echo{
-				ID: int(ident), Seq: int(seq),
-				Data: m.buffer[:m.dataSize],
-			},
-		}).Marshal(nil)
-		if err != nil {
-			return err
-		}
-		err = syscall.SetsockoptInt(m.socketFd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, m.currentTTL)
-		if err != nil {
-			return err
-		}
+	m.pending[sv.round] += 1
+	m.ev.enqueue(sv)
+	if err := m.transmit(sv, flow); err != nil {
+		// 发送失败的包同样等待超时, 算作丢包, 错误记录在结果中
+		r.entries[len(r.entries)-1].err = err
+		return sv, err
+	}
+	return sv, nil
+}
+
+func (m *Mtr) transmit(sv *seqValue, flow uint16) error {
+	b, sa, err := m.marshal(sv.ident, sv.seq, flow)
+	if err != nil {
+		return err
+	}
+	if err = m.setTTL(m.sendFd, sv.ttl); err != nil {
+		return err
 	}
-	return syscall.Sendto(m.socketFd, b, 0, m.sa)
+	return syscall.Sendto(m.sendFd, b, 0, sa)
+}
+
+// evQueue 按超时时间排序的探测包
+type evQueue struct {
+	first *seqValue
+	last  *seqValue
 }
 
-func (m *Mtr) evRemove(h *seqValue) {
-	if m.evFirst == h {
-		m.evFirst = h.evNext
+func (q *evQueue) remove(h *seqValue) {
+	if q.first == h {
+		q.first = h.evNext
 	}
-	if m.evLast == h {
-		m.evLast = h.evPrev
+	if q.last == h {
+		q.last = h.evPrev
 	}
 	if h.evPrev != nil {
 		h.evPrev.evNext = h.evNext
@@ -417,25 +780,25 @@ func (m *Mtr) evRemove(h *seqValue) {
 	h.evPrev = nil
 	h.evNext = nil
 }
-func (m *Mtr) evEnqueue(h *seqValue) {
+func (q *evQueue) enqueue(h *seqValue) {
 	var i *seqValue
 	var iPrev *seqValue
 	/* Empty list */
-	if m.evLast == nil {
+	if q.last == nil {
 		h.evNext = nil
 		h.evPrev = nil
-		m.evFirst = h
-		m.evLast = h
+		q.first = h
+		q.last = h
 		return
 	}
-	if h.evTime.After(m.evLast.evTime) {
+	if h.evTime.After(q.last.evTime) {
 		h.evNext = nil
-		h.evPrev = m.evLast
-		m.evLast.evNext = h
-		m.evLast = h
+		h.evPrev = q.last
+		q.last.evNext = h
+		q.last = h
 		return
 	}
-	i = m.evLast
+	i = q.last
 	for {
 		iPrev = i.evPrev
 		if iPrev == nil || h.evTime.After(iPrev.evTime) {
@@ -445,7 +808,7 @@ func (m *Mtr) evEnqueue(h *seqValue) {
 			if iPrev != nil {
 				iPrev.evNext = h
 			} else {
-				m.evFirst = h
+				q.first = h
 			}
 			return
 		}
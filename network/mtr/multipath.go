@@ -0,0 +1,230 @@
+package mtr
+
+import (
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+const DefaultConfidence = 0.95
+
+// MultipathOption 多路径探测 (MDA), 每个探测包使用不同的 flow, 枚举每一跳所有的下一跳,
+// confidence 为没有漏掉下一跳的置信度, 默认 DefaultConfidence, 只支持 icmp 和 udp, 结果在 Result.Graph
+func MultipathOption(confidence float64) Option {
+	return func(m *Mtr) {
+		if confidence <= 0 || confidence >= 1 {
+			confidence = DefaultConfidence
+		}
+		m.multipath = confidence
+		m.paris = true
+	}
+}
+
+// Node 多路径探测发现的节点, IP 为 nil 表示没有回复
+type Node struct {
+	TTL    int
+	IP     net.IP
+	Probes int  // 经过这个节点的探测包数量
+	End    bool // 目的地址, 或者返回 Destination Unreachable 的节点
+}
+
+// Link 相邻两跳之间的链路, From 在第 TTL 跳, To 在第 TTL+1 跳
+type Link struct {
+	TTL    int
+	From   net.IP
+	To     net.IP
+	Probes int
+}
+
+type Graph struct {
+	Nodes []Node
+	Links []Link
+}
+
+// mdaProbes 已经发现 k 个下一跳的时候, 一共需要发送多少个探测包才能以 confidence 的置信度确认没有第 k+1 个
+func mdaProbes(k int, confidence float64) int {
+	if k == 0 {
+		return 1
+	}
+	alpha := 1 - confidence
+	return int(math.Ceil(math.Log(alpha/float64(k+1)) / math.Log(float64(k)/float64(k+1))))
+}
+
+// newFlows 分配 n 个没有使用过的 flow, udp 的 flow 是目的端口的偏移
+func (m *Mtr) newFlows(n int) []uint16 {
+	max := math.MaxUint16
+	if m.protocol == ProtocolUDP {
+		max -= m.port
+	}
+	var flows []uint16
+	for ; n > 0 && m.nextFlow <= max; n-- {
+		flows = append(flows, uint16(m.nextFlow))
+		m.nextFlow += 1
+	}
+	return flows
+}
+
+// probeFlows 按 interval 发送一批探测包, 等待全部回复或者超时
+func (m *Mtr) probeFlows(ttl int, flows []uint16) []seqEntry {
+	svs := make([]*seqValue, 0, len(flows))
+	var lastSendTime time.Time
+	for len(svs) < len(flows) && !m.isClosing() {
+		if waitTime := m.interval - time.Now().Sub(lastSendTime); waitTime > 0 {
+			m.drain(waitTime)
+			continue
+		}
+		lastSendTime = time.Now()
+		sv, _ := m.sendProbe(ttl, flows[len(svs)], lastSendTime)
+		svs = append(svs, sv)
+	}
+	m.waitForAll()
+	entries := make([]seqEntry, len(svs))
+	for i, sv := range svs {
+		entries[i] = *m.entry(sv)
+	}
+	return entries
+}
+
+// discover 逐跳枚举上一跳每个节点的所有下一跳
+func (m *Mtr) discover() {
+	// hops[ttl][flow] 探测包经过的节点, "" 表示没有回复
+	hops := make([]map[uint16]string, m.maxTTL+1)
+	ends := map[string]bool{}
+	record := func(ttl int, flows []uint16, entries []seqEntry) {
+		if hops[ttl] == nil {
+			hops[ttl] = map[uint16]string{}
+		}
+		for i, e := range entries {
+			var key string
+			if len(e.ip) != 0 {
+				key = e.ip.String()
+			}
+			hops[ttl][flows[i]] = key
+			if e.end || e.unreachable != nil {
+				// 到达目的地址或者路径中断
+				ends[key] = true
+			}
+		}
+	}
+	for ttl := 1; ttl <= m.maxTTL && !m.isClosing(); ttl++ {
+		m.currentMaxTTL = ttl
+		// 按上一跳的节点分组, 第一跳只有本机一个节点
+		groups := map[string][]uint16{}
+		if ttl == 1 {
+			groups[""] = nil
+		}
+		for flow, key := range hops[ttl-1] {
+			if !ends[key] {
+				groups[key] = append(groups[key], flow)
+			}
+		}
+		if len(groups) == 0 {
+			break
+		}
+		keys := make([]string, 0, len(groups))
+		for key, flows := range groups {
+			sort.Slice(flows, func(i, j int) bool { return flows[i] < flows[j] })
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flows := groups[key]
+			found := map[string]bool{}
+			var sent, tries int
+			for !m.isClosing() {
+				need := mdaProbes(len(found), m.multipath) - sent
+				if need <= 0 {
+					break
+				}
+				batch := flows[sent:]
+				if len(batch) > need {
+					batch = batch[:need]
+				}
+				if len(batch) < need {
+					if ttl == 1 {
+						batch = append(batch, m.newFlows(need-len(batch))...)
+					} else if tries < 3 {
+						// 经过这个节点的 flow 不够, 在上一跳用新的 flow 寻找
+						tries++
+						extra := m.newFlows((need - len(batch)) * len(keys))
+						record(ttl-1, extra, m.probeFlows(ttl-1, extra))
+						for _, flow := range extra {
+							if hops[ttl-1][flow] == key {
+								flows = append(flows, flow)
+							}
+						}
+						continue
+					}
+				}
+				if len(batch) == 0 {
+					break
+				}
+				record(ttl, batch, m.probeFlows(ttl, batch))
+				for _, flow := range batch {
+					if next := hops[ttl][flow]; next != "" {
+						found[next] = true
+					}
+				}
+				if ttl == 1 {
+					flows = append(flows, batch...)
+				}
+				sent += len(batch)
+			}
+		}
+		// 所有的节点都是目的地址
+		reached := len(hops[ttl]) > 0
+		for _, key := range hops[ttl] {
+			if !ends[key] {
+				reached = false
+				break
+			}
+		}
+		if reached {
+			break
+		}
+	}
+	m.graph = buildGraph(hops, ends)
+}
+
+func buildGraph(hops []map[uint16]string, ends map[string]bool) *Graph {
+	type linkKey struct {
+		ttl      int
+		from, to string
+	}
+	g := &Graph{}
+	nodes := map[linkKey]int{}
+	links := map[linkKey]int{}
+	for ttl, flows := range hops {
+		for flow, key := range flows {
+			nodes[linkKey{ttl: ttl, to: key}] += 1
+			if ttl > 1 {
+				if from, ok := hops[ttl-1][flow]; ok {
+					links[linkKey{ttl: ttl - 1, from: from, to: key}] += 1
+				}
+			}
+		}
+	}
+	for k, n := range nodes {
+		g.Nodes = append(g.Nodes, Node{TTL: k.ttl, IP: net.ParseIP(k.to), Probes: n, End: k.to != "" && ends[k.to]})
+	}
+	for k, n := range links {
+		g.Links = append(g.Links, Link{TTL: k.ttl, From: net.ParseIP(k.from), To: net.ParseIP(k.to), Probes: n})
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		if g.Nodes[i].TTL != g.Nodes[j].TTL {
+			return g.Nodes[i].TTL < g.Nodes[j].TTL
+		}
+		return g.Nodes[i].IP.String() < g.Nodes[j].IP.String()
+	})
+	sort.Slice(g.Links, func(i, j int) bool {
+		if g.Links[i].TTL != g.Links[j].TTL {
+			return g.Links[i].TTL < g.Links[j].TTL
+		}
+		if !g.Links[i].From.Equal(g.Links[j].From) {
+			return g.Links[i].From.String() < g.Links[j].From.String()
+		}
+		return g.Links[i].To.String() < g.Links[j].To.String()
+	})
+	return g
+}
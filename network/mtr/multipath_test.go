@@ -0,0 +1,35 @@
+package mtr
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMDAProbes(t *testing.T) {
+	tests := []struct {
+		confidence float64
+		want       []int // k = 0, 1, 2, ...
+	}{
+		{0.90, []int{1, 5, 9, 13, 18, 23}},
+		// Veitch et al. "Failure Control in Multipath Route Tracing" 表 1
+		{DefaultConfidence, []int{1, 6, 11, 16, 21, 27}},
+		{0.99, []int{1, 8, 15, 21, 28, 36}},
+	}
+	for _, tt := range tests {
+		for k, want := range tt.want {
+			n := mdaProbes(k, tt.confidence)
+			if n != want {
+				t.Errorf("mdaProbes(%d, %v) = %d, want %d", k, tt.confidence, n, want)
+			}
+			if k == 0 {
+				continue
+			}
+			// n 个探测包都落在已知的 k 个下一跳上的概率不超过 alpha/(k+1), n-1 个的时候超过
+			alpha := (1 - tt.confidence) / float64(k+1)
+			p := float64(k) / float64(k+1)
+			if math.Pow(p, float64(n)) > alpha || math.Pow(p, float64(n-1)) <= alpha {
+				t.Errorf("mdaProbes(%d, %v) = %d is not the smallest n with (k/(k+1))^n <= %v", k, tt.confidence, n, alpha)
+			}
+		}
+	}
+}
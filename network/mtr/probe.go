@@ -0,0 +1,498 @@
+package mtr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"math"
+	"net"
+	"syscall"
+)
+
+type Protocol int
+
+const (
+	ProtocolICMP Protocol = iota // icmp echo
+	ProtocolUDP                  // 同 traceroute, 每个包的目的端口递增
+	ProtocolTCP                  // tcp syn, 需要 raw socket
+
+	DefaultUDPPort = 33434
+	DefaultTCPPort = 80
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolICMP:
+		return "icmp"
+	case ProtocolUDP:
+		return "udp"
+	case ProtocolTCP:
+		return "tcp"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// ProtocolOption 探测使用的协议, 默认 ProtocolICMP
+func ProtocolOption(p Protocol) Option {
+	return func(m *Mtr) {
+		m.protocol = p
+	}
+}
+
+// PortOption 目的端口, udp 默认 DefaultUDPPort (起始端口), tcp 默认 DefaultTCPPort
+func PortOption(port int) Option {
+	return func(m *Mtr) {
+		m.port = port
+	}
+}
+
+// ParisOption Paris traceroute, 探测包的 flow (icmp ident 和校验和, udp/tcp 端口) 保持不变,
+// 避免 ECMP 把同一轮的探测包分到不同的路径上
+//
+//	icmp: ident 不变, 修改 payload 的前 2 个字节补偿 seq 的变化, 校验和不变
+//	udp: 目的端口不变, seq 写入 udp 校验和 (修改 payload 的前 4 个字节)
+//	多路径探测的时候, icmp 修改 payload 的 3,4 字节, udp 修改目的端口, 改变 flow
+//	tcp: 本身就只通过 tcp seq 区分探测包
+func ParisOption() Option {
+	return func(m *Mtr) {
+		m.paris = true
+	}
+}
+
+// listen 创建发送和接收的 socket
+func (m *Mtr) listen() (err error) {
+	icmpType := m.socketType
+	if m.paris && m.protocol != ProtocolTCP && m.dataSize < 4 {
+		// 需要 payload 控制校验和
+		m.dataSize = 4
+	}
+	switch m.protocol {
+	case ProtocolICMP:
+	case ProtocolUDP:
+		if m.port <= 0 {
+			m.port = DefaultUDPPort
+		}
+		var bindIp net.IP
+		if m.paris {
+			// 计算校验和需要源地址, udp 校验和不能为 0, Tracer 共享的 socket 绑定所有地址
+			bindIp = m.localIp
+			m.seqPool.SetMaxSeq(math.MaxUint16 - 1)
+		} else {
+			// seq 作为目的端口的偏移
+			m.seqPool.SetMaxSeq(uint16(math.MaxUint16 - m.port))
+		}
+		if m.sendFd, m.srcPort, err = listenUDP(m.mode, bindIp); err != nil {
+			return err
+		}
+		if icmpType != icmp2.SocketRaw && icmp2.ErrQueueSupported {
+			// 不需要 raw socket, 从 udp socket 的 MSG_ERRQUEUE 读取差错报文
+			if err = icmp2.EnableRecvErr(m.sendFd, m.mode); err != nil {
+				return err
+			}
+			m.socketType = icmp2.SocketDgram
+			m.errQueueFd = m.sendFd
+			m.s.Add(m.sendFd)
+			return nil
+		}
+		icmpType = icmp2.SocketRaw
+	case ProtocolTCP:
+		if m.port <= 0 {
+			m.port = DefaultTCPPort
+		}
+		if m.multipath > 0 {
+			return errors.New("multipath discovery does not support tcp probe")
+		}
+		if icmpType == icmp2.SocketDgram {
+			return errors.New("tcp probe requires raw socket")
+		}
+		icmpType = icmp2.SocketRaw
+		if m.sendFd, m.srcPort, m.reserveFd, err = listenTCP(m.mode, m.localIp); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected protocol %v", m.protocol)
+	}
+	m.socketFd, m.socketType, err = icmp2.ListenSocket(m.mode, icmpType)
+	if err != nil {
+		return err
+	}
+	if m.protocol == ProtocolICMP {
+		m.sendFd = m.socketFd
+		if m.socketType == icmp2.SocketDgram {
+			// SOCK_DGRAM 收不到 Time Exceeded, 需要从 MSG_ERRQUEUE 读取
+			if err = icmp2.EnableRecvErr(m.socketFd, m.mode); err != nil {
+				return err
+			}
+			m.errQueueFd = m.socketFd
+		}
+	}
+	m.s.Add(m.socketFd)
+	if m.sendFd != m.socketFd {
+		m.s.Add(m.sendFd)
+	}
+	return nil
+}
+
+// needLocalIp paris udp 和 tcp 探测需要源地址计算校验和
+func (m *Mtr) needLocalIp() bool {
+	return m.protocol == ProtocolTCP || m.protocol == ProtocolUDP && m.paris
+}
+
+func domain(mode icmp2.Mode) int {
+	if mode == icmp2.IPV6Address {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
+func sockaddr(ip net.IP, port int) syscall.Sockaddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa
+	}
+	sa := &syscall.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return sa
+}
+
+// bindAddr ip 为 nil 的时候绑定所有地址
+func bindAddr(mode icmp2.Mode, ip net.IP) syscall.Sockaddr {
+	if ip != nil {
+		return sockaddr(ip, 0)
+	}
+	if mode == icmp2.IPV6Address {
+		return &syscall.SockaddrInet6{}
+	}
+	return &syscall.SockaddrInet4{}
+}
+
+func sockaddrIP(sa syscall.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	case *syscall.SockaddrInet6:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	}
+	return nil
+}
+
+func sockaddrPort(sa syscall.Sockaddr) int {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return sa.Port
+	case *syscall.SockaddrInet6:
+		return sa.Port
+	}
+	return 0
+}
+
+// listenUDP 绑定一个本地端口, 作为所有探测包的源端口, ip 为 nil 的时候绑定所有地址
+func listenUDP(mode icmp2.Mode, ip net.IP) (int, int, error) {
+	fd, err := syscall.Socket(domain(mode), syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = unix.SetNonblock(fd, true); err == nil {
+		err = syscall.Bind(fd, bindAddr(mode, ip))
+	}
+	var sa syscall.Sockaddr
+	if err == nil {
+		sa, err = syscall.Getsockname(fd)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return 0, 0, err
+	}
+	return fd, sockaddrPort(sa), nil
+}
+
+// listenTCP 通过 raw socket 发送 syn, 同时绑定一个 tcp socket 占用源端口, localIp 为 nil 的时候占用所有地址的端口
+func listenTCP(mode icmp2.Mode, localIp net.IP) (int, int, int, error) {
+	reserveFd, err := syscall.Socket(domain(mode), syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var sa syscall.Sockaddr
+	if err = syscall.Bind(reserveFd, bindAddr(mode, localIp)); err == nil {
+		sa, err = syscall.Getsockname(reserveFd)
+	}
+	if err != nil {
+		unix.Close(reserveFd)
+		return 0, 0, 0, err
+	}
+	fd, err := syscall.Socket(domain(mode), syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err == nil {
+		if err = unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		unix.Close(reserveFd)
+		return 0, 0, 0, err
+	}
+	return fd, sockaddrPort(sa), reserveFd, nil
+}
+
+func (m *Mtr) setTTL(fd int, ttl int) error {
+	if m.mode == icmp2.IPV6Address {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
+
+// marshal 生成探测包, ident 和 seq 用于匹配回复, flow 决定 paris 模式下探测包的路径
+func (m *Mtr) marshal(ident, seq, flow uint16) ([]byte, syscall.Sockaddr, error) {
+	if m.dataSize > len(m.buffer) {
+		m.buffer = make([]byte, m.dataSize)
+	}
+	data := m.buffer[:m.dataSize]
+	if m.paris {
+		// 固定的 payload, 只修改前面几个字节
+		data = make([]byte, m.dataSize)
+	}
+	switch m.protocol {
+	case ProtocolUDP:
+		if m.paris {
+			binary.BigEndian.PutUint16(data, seq)
+			binary.BigEndian.PutUint16(data[2:], m.udpCompensation(m.port+int(flow), data, seq+1))
+			return data, sockaddr(m.ip, m.port+int(flow)), nil
+		}
+		// 目的端口 = 起始端口 + seq
+		return data, sockaddr(m.ip, m.port+int(seq)), nil
+	case ProtocolTCP:
+		b := make([]byte, 24)
+		binary.BigEndian.PutUint16(b[0:], uint16(m.srcPort))
+		binary.BigEndian.PutUint16(b[2:], uint16(m.port))
+		binary.BigEndian.PutUint32(b[4:], uint32(ident)<<16|uint32(seq))
+		b[12] = 6 << 4 // data offset, 包含 mss option
+		b[13] = tcpFlagSYN
+		binary.BigEndian.PutUint16(b[14:], math.MaxUint16)
+		b[20], b[21] = 2, 4 // mss
+		binary.BigEndian.PutUint16(b[22:], 1460)
+		sum := checksum(pseudoHeaderSum(m.localIp, m.ip, syscall.IPPROTO_TCP, len(b)), b)
+		binary.BigEndian.PutUint16(b[16:], foldChecksum(sum))
+		return b, m.sa, nil
+	}
+	if m.paris {
+		// seq + ^seq = 0xffff, 校验和不随 seq 变化
+		ident = uint16(m.ident)
+		binary.BigEndian.PutUint16(data, ^seq)
+		binary.BigEndian.PutUint16(data[2:], flow)
+	}
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if m.mode == icmp2.IPV6Address {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	b, err := (&icmp.Message{
+		Type: typ, Code: 0,
+		Body: &icmp.Echo{
+			ID: int(ident), Seq: int(seq),
+			Data: data,
+		},
+	}).Marshal(nil)
+	return b, m.sa, err
+}
+
+// parseQuote 从 icmp 差错报文中引用的原始报文 (ip 头 + 至少 8 个字节) 中找到探测包的 ident 和 seq
+func (m *Mtr) parseQuote(b []byte) (uint16, uint16, bool) {
+	var (
+		proto int
+		dst   net.IP
+	)
+	if m.mode == icmp2.IPV4Address {
+		if len(b) < 20 || b[0]>>4 != 4 || len(b) < int(b[0]&0x0f)<<2 {
+			return 0, 0, false
+		}
+		proto = int(b[9])
+		dst = net.IP(b[16:20])
+		b = b[int(b[0]&0x0f)<<2:]
+	} else {
+		if len(b) < ipv6.HeaderLen || b[0]>>4 != 6 {
+			return 0, 0, false
+		}
+		proto = int(b[6])
+		dst = net.IP(b[24:40])
+		b = b[ipv6.HeaderLen:]
+		// 跳过扩展头
+		for {
+			var l int
+			switch proto {
+			case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+				if len(b) < 2 {
+					return 0, 0, false
+				}
+				l = (int(b[1]) + 1) * 8
+			case ipv6Fragment:
+				l = 8
+			}
+			if l == 0 {
+				break
+			}
+			if len(b) < l {
+				return 0, 0, false
+			}
+			proto = int(b[0])
+			b = b[l:]
+		}
+	}
+	if m.ip != nil && !dst.Equal(m.ip) {
+		// Tracer 共享的 socket 没有目标地址, 只通过 ident 和 seq 匹配
+		return 0, 0, false
+	}
+	return m.decodeProbe(proto, b)
+}
+
+// decodeProbe b 从原始报文的 4 层头开始
+func (m *Mtr) decodeProbe(proto int, b []byte) (uint16, uint16, bool) {
+	if len(b) < 8 {
+		return 0, 0, false
+	}
+	sport, dport := int(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))
+	switch m.protocol {
+	case ProtocolUDP:
+		if proto != syscall.IPPROTO_UDP || sport != m.srcPort || dport < m.port {
+			return 0, 0, false
+		}
+		if m.paris {
+			return 0, binary.BigEndian.Uint16(b[6:]) - 1, true
+		}
+		return 0, uint16(dport - m.port), true
+	case ProtocolTCP:
+		if proto != syscall.IPPROTO_TCP || sport != m.srcPort || dport != m.port {
+			return 0, 0, false
+		}
+		v := binary.BigEndian.Uint32(b[4:])
+		return uint16(v >> 16), uint16(v), true
+	}
+	if (proto != syscall.IPPROTO_ICMP || b[0] != byte(ipv4.ICMPTypeEcho)) &&
+		(proto != syscall.IPPROTO_ICMPV6 || b[0] != byte(ipv6.ICMPTypeEchoRequest)) {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:]), true
+}
+
+// readErrQueue SOCK_DGRAM 的 icmp socket 和 udp socket 从 MSG_ERRQUEUE 读取差错报文
+func (m *Mtr) readErrQueue(fd int) bool {
+	n, se, err := icmp2.ReadErrQueue(fd, m.buffer)
+	if err != nil {
+		return false
+	}
+	var ident, seq uint16
+	if m.protocol == ProtocolUDP {
+		// udp 的差错报文中不包含 udp 头, 通过目的端口匹配
+		if se.Port < m.port {
+			return true
+		}
+		seq = uint16(se.Port - m.port)
+		if m.paris {
+			// 目的端口不变, payload 的前 2 个字节是 seq
+			if n < 2 {
+				return true
+			}
+			seq = binary.BigEndian.Uint16(m.buffer)
+		}
+	} else {
+		// 原始发送的 echo 报文
+		if n < 8 {
+			return true
+		}
+		ident, seq = binary.BigEndian.Uint16(m.buffer[4:]), binary.BigEndian.Uint16(m.buffer[6:])
+	}
+	switch {
+	case (m.mode == icmp2.IPV4Address && se.Type == uint8(ipv4.ICMPTypeTimeExceeded)) ||
+		(m.mode == icmp2.IPV6Address && se.Type == uint8(ipv6.ICMPTypeTimeExceeded)):
+		m.timeExceeded(se.Offender, ident, seq, nil)
+	case isDestUnreachable(m.mode, int(se.Type)):
+		// frag needed 的时候 info 是 mtu
+		m.destUnreachable(se.Offender, ident, seq, newUnreachable(m.mode, int(se.Type), int(se.Code), int(se.Info)), nil)
+	}
+	return true
+}
+
+// ipv6 扩展头
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6DestOpts = 60
+)
+
+func icmpType(t icmp.Type) int {
+	switch t := t.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	}
+	return -1
+}
+
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// tcpReply raw tcp socket 收到目的地址回复的 syn+ack 或者 rst
+func (m *Mtr) tcpReply(b []byte, src net.IP) {
+	if m.mode == icmp2.IPV4Address {
+		_, start := icmp2.StripIPv4Header(b)
+		b = b[start:]
+	}
+	if len(b) < 20 || m.ip != nil && !src.Equal(m.ip) {
+		return
+	}
+	if int(binary.BigEndian.Uint16(b)) != m.port || int(binary.BigEndian.Uint16(b[2:])) != m.srcPort {
+		return
+	}
+	if b[13]&tcpFlagACK == 0 || b[13]&(tcpFlagSYN|tcpFlagRST) == 0 {
+		return
+	}
+	v := binary.BigEndian.Uint32(b[8:]) - 1
+	m.echoReply(src, uint16(v>>16), uint16(v))
+}
+
+// udpCompensation 计算 payload[2:4] 的值, 使 udp 校验和等于 want
+func (m *Mtr) udpCompensation(port int, data []byte, want uint16) uint16 {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:], uint16(m.srcPort))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(port))
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(hdr)+len(data)))
+	sum := pseudoHeaderSum(m.localIp, m.ip, syscall.IPPROTO_UDP, len(hdr)+len(data))
+	sum = checksum(checksum(sum, hdr), data)
+	// 反码运算: w = ^want - sum
+	return ^foldChecksum(uint32(^want) + uint32(foldChecksum(sum)))
+}
+
+func checksum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeaderSum(src, dst net.IP, proto int, length int) uint32 {
+	var sum uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		sum = checksum(checksum(sum, src4), dst4)
+	} else {
+		sum = checksum(checksum(sum, src.To16()), dst.To16())
+	}
+	return sum + uint32(proto) + uint32(length)
+}
@@ -0,0 +1,226 @@
+package mtr
+
+import (
+	"encoding/binary"
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// udpChecksum 按内核的方式计算 udp 校验和, 结果为 0 的时候发送 0xffff (RFC 768)
+func udpChecksum(m *Mtr, port int, data []byte) uint16 {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:], uint16(m.srcPort))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(port))
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(hdr)+len(data)))
+	sum := pseudoHeaderSum(m.localIp, m.ip, syscall.IPPROTO_UDP, len(hdr)+len(data))
+	if sum = uint32(foldChecksum(checksum(checksum(sum, hdr), data))); sum == 0 {
+		return 0xffff
+	}
+	return uint16(sum)
+}
+
+func TestParisUDPChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     icmp2.Mode
+		local    string
+		ip       string
+		dataSize int
+		flow     uint16
+	}{
+		{"ipv4", icmp2.IPV4Address, "192.0.2.1", "198.51.100.7", 4, 0},
+		{"ipv4 odd payload", icmp2.IPV4Address, "192.0.2.1", "198.51.100.7", 37, 0},
+		{"ipv4 flow", icmp2.IPV4Address, "10.1.2.3", "203.0.113.200", 64, 5},
+		{"ipv6", icmp2.IPV6Address, "2001:db8::1", "2001:db8:ffff::53", 4, 0},
+		{"ipv6 flow", icmp2.IPV6Address, "2001:db8::1", "2001:db8:ffff::53", 56, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Mtr{
+				mode: tt.mode, protocol: ProtocolUDP, paris: true, dataSize: tt.dataSize,
+				localIp: net.ParseIP(tt.local), ip: net.ParseIP(tt.ip), srcPort: 40000, port: 33434,
+			}
+			// paris 模式 seq 最大为 0xfffe, 校验和不能为 0
+			for _, seq := range []uint16{0, 1, 2, 255, 256, 0x1234, 0xfffe} {
+				data, sa, err := m.marshal(0, seq, tt.flow)
+				if err != nil {
+					t.Fatal(err)
+				}
+				port := m.port + int(tt.flow)
+				if got := sockaddrPort(sa); got != port {
+					t.Fatalf("seq %d: port = %d, want %d", seq, got, port)
+				}
+				sum := udpChecksum(m, port, data)
+				if sum != seq+1 {
+					t.Fatalf("seq %d: udp checksum = %#04x, want %#04x", seq, sum, seq+1)
+				}
+				// 差错报文引用的 udp 头中解码出 seq
+				hdr := make([]byte, 8)
+				binary.BigEndian.PutUint16(hdr[0:], uint16(m.srcPort))
+				binary.BigEndian.PutUint16(hdr[2:], uint16(port))
+				binary.BigEndian.PutUint16(hdr[6:], sum)
+				if _, got, ok := m.decodeProbe(syscall.IPPROTO_UDP, hdr); !ok || got != seq {
+					t.Fatalf("seq %d: decodeProbe = %d, %v", seq, got, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestParisICMPChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataSize int
+		flows    []uint16
+	}{
+		{"min payload", 4, []uint16{0}},
+		{"odd payload", 33, []uint16{0, 1}},
+		{"flows", 56, []uint16{0, 1, 2, 0x8000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Mtr{
+				mode: icmp2.IPV4Address, protocol: ProtocolICMP, paris: true, dataSize: tt.dataSize,
+				ident: 0x4242, ip: net.ParseIP("198.51.100.7"),
+			}
+			sums := map[uint16]uint16{}
+			for _, flow := range tt.flows {
+				for _, seq := range []uint16{0, 1, 2, 255, 256, 0x1234, 0xffff} {
+					b, _, err := m.marshal(0x1111, seq, flow)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if foldChecksum(checksum(0, b)) != 0 {
+						t.Fatalf("flow %d seq %d: invalid icmp checksum", flow, seq)
+					}
+					if id := binary.BigEndian.Uint16(b[4:]); id != uint16(m.ident) {
+						t.Fatalf("flow %d seq %d: ident = %#04x, want %#04x", flow, seq, id, m.ident)
+					}
+					if s := binary.BigEndian.Uint16(b[6:]); s != seq {
+						t.Fatalf("flow %d seq %d: seq = %d", flow, seq, s)
+					}
+					sum := binary.BigEndian.Uint16(b[2:])
+					if want, ok := sums[flow]; !ok {
+						sums[flow] = sum
+					} else if sum != want {
+						t.Fatalf("flow %d seq %d: icmp checksum = %#04x, want %#04x", flow, seq, sum, want)
+					}
+				}
+			}
+			// 不同的 flow 校验和不同, ECMP 才会分到不同的路径
+			seen := map[uint16]uint16{}
+			for flow, sum := range sums {
+				if other, ok := seen[sum]; ok {
+					t.Fatalf("flow %d and %d have the same checksum %#04x", flow, other, sum)
+				}
+				seen[sum] = flow
+			}
+		})
+	}
+}
+
+// ipv6Quote 被引用的 icmpv6 echo request, next 是第一个头的类型, exts 是扩展头
+func ipv6Quote(next byte, exts ...[]byte) []byte {
+	b := make([]byte, 40)
+	b[0] = 6 << 4
+	b[6], b[7] = next, 1
+	copy(b[8:], net.ParseIP("2001:db8::1"))
+	copy(b[24:], net.ParseIP("2001:db8:ffff::53"))
+	for _, ext := range exts {
+		b = append(b, ext...)
+	}
+	return append(b, 128, 0, 0, 0, 0x42, 0x42, 0x00, 0x07) // ident 0x4242, seq 7
+}
+
+func TestParseQuoteIPv6(t *testing.T) {
+	hopByHop := []byte{syscall.IPPROTO_ICMPV6, 0, 1, 4, 0, 0, 0, 0}
+	tests := []struct {
+		name  string
+		quote []byte
+		ip    string
+		ok    bool
+	}{
+		{"echo", ipv6Quote(syscall.IPPROTO_ICMPV6), "2001:db8:ffff::53", true},
+		{"hop-by-hop", ipv6Quote(ipv6HopByHop, hopByHop), "2001:db8:ffff::53", true},
+		{"hop-by-hop 16 bytes", ipv6Quote(ipv6HopByHop, []byte{syscall.IPPROTO_ICMPV6, 1, 1, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), "2001:db8:ffff::53", true},
+		{"routing and fragment", ipv6Quote(ipv6Routing,
+			[]byte{ipv6Fragment, 0, 0, 0, 0, 0, 0, 0},
+			[]byte{syscall.IPPROTO_ICMPV6, 0, 0, 0, 0, 0, 0, 1}), "2001:db8:ffff::53", true},
+		{"other target", ipv6Quote(syscall.IPPROTO_ICMPV6), "2001:db8::53", false},
+		{"tracer", ipv6Quote(syscall.IPPROTO_ICMPV6), "", true},
+		{"ipv4 header", udpQuote, "", false},
+		{"extension longer than quote", ipv6Quote(ipv6HopByHop, []byte{syscall.IPPROTO_ICMPV6, 2, 1, 4, 0, 0, 0, 0}), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Mtr{mode: icmp2.IPV6Address, protocol: ProtocolICMP, ip: net.ParseIP(tt.ip)}
+			ident, seq, ok := m.parseQuote(tt.quote)
+			if ok != tt.ok {
+				t.Fatalf("parseQuote ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && (ident != 0x4242 || seq != 7) {
+				t.Fatalf("parseQuote = %#04x, %d, want 0x4242, 7", ident, seq)
+			}
+			// 被截断的引用不能 panic, 也不能匹配
+			for n := 0; n < len(tt.quote); n++ {
+				if _, _, ok := m.parseQuote(tt.quote[:n]); ok {
+					t.Fatalf("parseQuote(quote[:%d]) ok, want false", n)
+				}
+			}
+		})
+	}
+}
+
+func TestParisICMPIdent(t *testing.T) {
+	const ident = 0x1234
+	tests := []struct {
+		name       string
+		socketType icmp2.SocketType
+		maxSeq     uint16 // 不为 0 的时候 seq 溢出, seqPool 的 ident 变化
+		ident      uint16 // 回复的 ident
+		match      bool
+	}{
+		{"raw", icmp2.SocketRaw, 0, ident, true},
+		{"raw foreign ident", icmp2.SocketRaw, 0, ident + 1, false},
+		{"raw seq overflow", icmp2.SocketRaw, 1, ident, true},
+		{"raw seq overflow foreign ident", icmp2.SocketRaw, 1, ident + 1, false},
+		// 内核改写了 ident
+		{"dgram", icmp2.SocketDgram, 0, ident + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMtr(t, ParisOption(), SocketTypeOption(tt.socketType), IdentOption(ident), MaxTTLOption(3))
+			if tt.maxSeq != 0 {
+				m.seqPool.SetMaxSeq(tt.maxSeq)
+			}
+			now := time.Now()
+			for i := 0; i < 3; i++ {
+				m.step(now)
+			}
+			if tt.maxSeq != 0 && m.ev.first.ident == ident {
+				t.Fatal("seqPool ident did not change")
+			}
+			hop := net.ParseIP("10.0.0.1")
+			for val := m.ev.first; val != nil; val = m.ev.first {
+				ttl := val.ttl
+				if ttl == 3 {
+					m.echoReply(m.ip, tt.ident, val.seq)
+				} else {
+					m.timeExceeded(hop, tt.ident, val.seq, nil)
+				}
+				if !tt.match {
+					if m.ev.first != val || m.result[ttl].reply != 0 {
+						t.Fatalf("ttl %d: reply with ident %#x was matched", ttl, tt.ident)
+					}
+					return
+				}
+				if m.result[ttl].reply != 1 {
+					t.Fatalf("ttl %d: reply = %d, want 1", ttl, m.result[ttl].reply)
+				}
+			}
+		})
+	}
+}
@@ -1,32 +1,155 @@
 package mtr
 
 import (
+	"math"
 	"net"
 	"time"
 )
 
 type TTLResultEntry struct {
-	IP      net.IP
-	Elapsed time.Duration
+	IP         net.IP
+	Elapsed    time.Duration
+	MPLS       []MPLSLabel     // RFC 4950 MPLS 标签栈
+	Interfaces []InterfaceInfo // RFC 5837 接口信息
+	// Unreachable 返回的是 Destination Unreachable, 不是 Time Exceeded or 目的地址的回复
+	Unreachable *Unreachable
+	Err         error // 发送失败, 这个包算作丢包
 }
+
+// Stats 一组 rtt 的统计, 没有收到回复的时候都是 0
+type Stats struct {
+	Received int
+	Last     time.Duration // 最后一次收到回复的 rtt
+	Best     time.Duration
+	Worst    time.Duration
+	Avg      time.Duration
+	StdDev   time.Duration
+	Jitter   time.Duration // 相邻两次 rtt 差的平均值
+}
+
+// HostStats 同一跳中每个 IP 的统计
+type HostStats struct {
+	IP   net.IP
+	Name string // PTR, 需要 ReverseDNSOption
+	ASN  *ASN   // 需要 ASNOption
+	Stats
+	MPLS        []MPLSLabel // 最后一次回复中的 MPLS 标签栈
+	Interfaces  []InterfaceInfo
+	Unreachable *Unreachable // 最后一次回复的 Destination Unreachable
+}
+
 type TTLResult struct {
 	Entries []TTLResultEntry
+	Sent    int
+	Loss    float64 // 丢包率, 百分比
+	Stats
+	Hosts   []HostStats // 按第一次回复的顺序
+	SendErr error       // 最后一次发送失败的错误
+}
+
+func newTTLResult(entries []TTLResultEntry) TTLResult {
+	tr := TTLResult{Entries: entries, Sent: len(entries)}
+	var (
+		times []time.Duration
+		index = map[string]int{}
+		hosts [][]time.Duration
+	)
+	for _, entry := range entries {
+		if entry.Err != nil {
+			tr.SendErr = entry.Err
+		}
+		if len(entry.IP) == 0 {
+			continue
+		}
+		times = append(times, entry.Elapsed)
+		key := entry.IP.String()
+		i, ok := index[key]
+		if !ok {
+			i = len(hosts)
+			index[key] = i
+			hosts = append(hosts, nil)
+			tr.Hosts = append(tr.Hosts, HostStats{IP: entry.IP})
+		}
+		hosts[i] = append(hosts[i], entry.Elapsed)
+		if len(entry.MPLS) > 0 {
+			tr.Hosts[i].MPLS = entry.MPLS
+		}
+		if len(entry.Interfaces) > 0 {
+			tr.Hosts[i].Interfaces = entry.Interfaces
+		}
+		tr.Hosts[i].Unreachable = entry.Unreachable
+	}
+	tr.Stats = statistics(times)
+	for i := range tr.Hosts {
+		tr.Hosts[i].Stats = statistics(hosts[i])
+	}
+	if tr.Sent > 0 {
+		tr.Loss = float64(tr.Sent-tr.Received) / float64(tr.Sent) * 100
+	}
+	return tr
+}
+
+func statistics(times []time.Duration) (s Stats) {
+	var (
+		sum     time.Duration
+		sumJit  time.Duration
+		squares float64
+	)
+	for _, duration := range times {
+		if s.Received > 0 {
+			d := duration - s.Last
+			if d < 0 {
+				d = -d
+			}
+			sumJit += d
+		}
+		s.Last = duration
+		s.Received += 1
+		sum += duration
+		squares += float64(duration) * float64(duration)
+		if s.Best == 0 || s.Best > duration {
+			s.Best = duration
+		}
+		if s.Worst < duration {
+			s.Worst = duration
+		}
+	}
+	if s.Received == 0 {
+		return
+	}
+	s.Avg = sum / time.Duration(s.Received)
+	if v := squares/float64(s.Received) - float64(s.Avg)*float64(s.Avg); v > 0 {
+		s.StdDev = time.Duration(math.Sqrt(v))
+	}
+	if s.Received > 1 {
+		s.Jitter = sumJit / time.Duration(s.Received-1)
+	}
+	return
 }
 
 type Result struct {
-	LocalIp  net.IP
-	TargetIp net.IP
-	TTL      []TTLResult
+	Target      string
+	ResolveTime time.Duration // 解析 Target 的耗时, Target 是 ip 的时候为 0
+	LocalIp     net.IP
+	TargetIp    net.IP
+	TTL         []TTLResult
+	Graph       *Graph // 多路径探测的结果, 只有 MultipathOption 的时候才有
 }
 
 type seqEntry struct {
-	t         time.Time
-	ip        net.IP
-	replyTime time.Time
-	end       bool
+	round       int
+	mpls        []MPLSLabel
+	interfaces  []InterfaceInfo
+	unreachable *Unreachable
+	t           time.Time
+	ip          net.IP
+	replyTime   time.Time
+	end         bool
+	err         error // 发送失败
 }
 
 type seqResult struct {
+	base    int // entries[0] 的 index, 前面的已经被 prune
 	entries []seqEntry
 	reply   int
 }
@@ -0,0 +1,99 @@
+package mtr
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewTTLResultSendErr(t *testing.T) {
+	errSend := errors.New("sendto: network is unreachable")
+	tr := newTTLResult([]TTLResultEntry{
+		{IP: net.ParseIP("10.0.0.1"), Elapsed: time.Millisecond},
+		{Err: errSend},
+		{IP: net.ParseIP("10.0.0.1"), Elapsed: 3 * time.Millisecond},
+	})
+	if tr.SendErr != errSend {
+		t.Fatalf("SendErr = %v, want %v", tr.SendErr, errSend)
+	}
+	if tr.Sent != 3 || tr.Received != 2 {
+		t.Fatalf("Sent/Received = %d/%d, want 3/2", tr.Sent, tr.Received)
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name  string
+		times []time.Duration
+		want  Stats
+	}{
+		{"empty", nil, Stats{}},
+		{"one", []time.Duration{5 * ms}, Stats{Received: 1, Last: 5 * ms, Best: 5 * ms, Worst: 5 * ms, Avg: 5 * ms}},
+		{"alternate", []time.Duration{10 * ms, 20 * ms, 10 * ms, 20 * ms},
+			Stats{Received: 4, Last: 20 * ms, Best: 10 * ms, Worst: 20 * ms, Avg: 15 * ms, StdDev: 5 * ms, Jitter: 10 * ms}},
+		{"increase", []time.Duration{1 * ms, 2 * ms, 3 * ms, 4 * ms},
+			Stats{Received: 4, Last: 4 * ms, Best: 1 * ms, Worst: 4 * ms, Avg: 2500 * time.Microsecond, StdDev: 1118033, Jitter: ms}},
+		{"spike", []time.Duration{2 * ms, 2 * ms, 14 * ms, 2 * ms},
+			Stats{Received: 4, Last: 2 * ms, Best: 2 * ms, Worst: 14 * ms, Avg: 5 * ms, StdDev: 5196152, Jitter: 8 * ms}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statistics(tt.times); got != tt.want {
+				t.Fatalf("statistics = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTTLResult(t *testing.T) {
+	ms := time.Millisecond
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	unreachable := &Unreachable{Type: 3, Code: 13}
+	tests := []struct {
+		name    string
+		entries []TTLResultEntry
+		sent    int
+		loss    float64
+		stats   Stats
+		hosts   []HostStats
+	}{
+		{"no reply", []TTLResultEntry{{}, {}}, 2, 100, Stats{}, nil},
+		{
+			"loss and hosts",
+			[]TTLResultEntry{
+				{IP: a, Elapsed: 10 * ms},
+				{},
+				{IP: b, Elapsed: 30 * ms, Unreachable: unreachable},
+				{IP: a, Elapsed: 20 * ms},
+			},
+			4, 25,
+			Stats{Received: 3, Last: 20 * ms, Best: 10 * ms, Worst: 30 * ms, Avg: 20 * ms, StdDev: 8164965, Jitter: 15 * ms},
+			[]HostStats{
+				{IP: a, Stats: Stats{Received: 2, Last: 20 * ms, Best: 10 * ms, Worst: 20 * ms, Avg: 15 * ms, StdDev: 5 * ms, Jitter: 10 * ms}},
+				{IP: b, Stats: Stats{Received: 1, Last: 30 * ms, Best: 30 * ms, Worst: 30 * ms, Avg: 30 * ms}, Unreachable: unreachable},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTTLResult(tt.entries)
+			if tr.Sent != tt.sent || tr.Loss != tt.loss {
+				t.Fatalf("Sent/Loss = %d/%v, want %d/%v", tr.Sent, tr.Loss, tt.sent, tt.loss)
+			}
+			if tr.Stats != tt.stats {
+				t.Fatalf("Stats = %+v, want %+v", tr.Stats, tt.stats)
+			}
+			if len(tr.Hosts) != len(tt.hosts) {
+				t.Fatalf("Hosts = %+v, want %+v", tr.Hosts, tt.hosts)
+			}
+			for i, h := range tr.Hosts {
+				want := tt.hosts[i]
+				if !h.IP.Equal(want.IP) || h.Stats != want.Stats || h.Unreachable != want.Unreachable {
+					t.Fatalf("Hosts[%d] = %+v, want %+v", i, h, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package mtr
+
+// TargetHeap Tracer 中按下一个探测包的发送时间排序的目标
+type TargetHeap []*Mtr
+
+func (th *TargetHeap) Push(x interface{}) {
+	n := len(*th)
+	item := x.(*Mtr)
+	item.index = n
+	*th = append(*th, item)
+}
+
+func (th *TargetHeap) Peek() interface{} {
+	old := *th
+	if len(old) <= 0 {
+		return nil
+	}
+	return old[0]
+}
+
+func (th *TargetHeap) Pop() interface{} {
+	old := *th
+	n := len(old)
+	item := old[n-1]
+	item.index = -1 // for safety
+	*th = old[0 : n-1]
+	return item
+}
+
+func (th *TargetHeap) Len() int { return len(*th) }
+
+func (th *TargetHeap) Less(i, j int) bool {
+	return (*th)[i].sendAt.Before((*th)[j].sendAt)
+}
+
+func (th *TargetHeap) Swap(i, j int) {
+	(*th)[i], (*th)[j] = (*th)[j], (*th)[i]
+	(*th)[i].index = i
+	(*th)[j].index = j
+}
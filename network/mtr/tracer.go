@@ -0,0 +1,364 @@
+package mtr
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/neo-hu/network-probe-tool/network"
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	_select "github.com/neo-hu/network-probe-tool/pkg/select"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultTracerInterval = time.Millisecond
+
+// Tracer 同时探测多个目标, 每个地址族只创建一组 socket, 所有目标共享 seqPool 和超时队列,
+// 所有目标的发包按 TracerIntervalOption 全局限速
+type Tracer struct {
+	s     *_select.Select
+	opts  []Option
+	base  *Mtr                // 默认的配置, 共享的 seqPool 和超时队列
+	conns map[icmp2.Mode]*Mtr // 每个地址族共享的 socket
+
+	// mu 保护 targets/targetHeap, Start 只有在等待回复的时候才会释放
+	mu           sync.Mutex
+	ctx          context.Context
+	interval     time.Duration
+	lastSendTime time.Time
+	targets      []*Mtr // Add 的顺序
+	targetHeap   TargetHeap
+
+	startingFlag int32
+	closeFlag    int32
+}
+
+type TracerOption func(*Tracer)
+
+// TracerIntervalOption 所有目标之间发包的最小间隔, 默认 DefaultTracerInterval,
+// 每个目标自己的发包间隔是 IntervalOption
+func TracerIntervalOption(interval time.Duration) TracerOption {
+	return func(t *Tracer) {
+		t.interval = interval
+	}
+}
+
+// TracerTargetOption 所有目标默认的配置, 协议, 端口, paris, socket 类型和 ident 所有目标共享, Add 的时候不能修改
+func TracerTargetOption(opts ...Option) TracerOption {
+	return func(t *Tracer) {
+		t.opts = append(t.opts, opts...)
+	}
+}
+
+func NewTracer(opts ...TracerOption) *Tracer {
+	t := &Tracer{
+		s:        _select.NewSelect(),
+		interval: DefaultTracerInterval,
+		conns:    map[icmp2.Mode]*Mtr{},
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.base = defaultMtr()
+	for _, opt := range t.opts {
+		opt(t.base)
+	}
+	t.base.seqPool = icmp2.NewSeqPool(uint16(t.base.ident))
+	t.base.ev = &evQueue{}
+	return t
+}
+
+// Add 添加一个目标, 可以在 Start 运行的时候从其它 goroutine 调用, opts 覆盖 TracerTargetOption 的配置,
+// 共享的协议, 端口, paris, socket 类型和 ident 和 TracerTargetOption 不同的时候返回错误
+func (t *Tracer) Add(target string, opts ...Option) error {
+	m, err := newMtr(target, append(append([]Option(nil), t.opts...), opts...))
+	if err != nil {
+		return err
+	}
+	if m.multipath > 0 {
+		return errors.New("tracer does not support multipath discovery")
+	}
+	if name := t.conflict(m); name != "" {
+		return fmt.Errorf("tracer targets share the %s, set it with TracerTargetOption", name)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.isClosing() {
+		return network.ErrAlreadyClosed
+	}
+	c, err := t.listen(m.mode)
+	if err != nil {
+		return err
+	}
+	m.s, m.seqPool, m.ev = t.s, c.seqPool, c.ev
+	m.socketFd, m.sendFd, m.errQueueFd, m.socketType = c.socketFd, c.sendFd, c.errQueueFd, c.socketType
+	m.protocol, m.port, m.srcPort, m.paris, m.ident = c.protocol, c.port, c.srcPort, c.paris, c.ident
+	if m.localIp == nil && m.needLocalIp() {
+		return errors.New("local ip addr not found")
+	}
+	if m.paris && m.protocol != ProtocolTCP && m.dataSize < 4 {
+		m.dataSize = 4
+	}
+	t.targets = append(t.targets, m)
+	heap.Push(&t.targetHeap, m)
+	if atomic.LoadInt32(&t.startingFlag) == 1 {
+		m.begin(time.Now())
+		if m.enrich != nil {
+			m.enrich.ctx = t.ctx
+		}
+		// 重新计算等待的时间
+		t.s.Wakeup()
+	}
+	return nil
+}
+
+// conflict 返回 m 和共享的 socket 不同的配置
+func (t *Tracer) conflict(m *Mtr) string {
+	b := t.base
+	switch {
+	case m.protocol != b.protocol:
+		return "protocol"
+	case m.port != b.port:
+		return "port"
+	case m.paris != b.paris:
+		return "paris option"
+	case m.socketType != b.socketType:
+		return "socket type"
+	case m.ident != b.ident:
+		return "ident"
+	}
+	return ""
+}
+
+// Remove 删除 target 对应的目标, 可以在 Start 运行的时候从其它 goroutine 调用, 已经发送的探测包不再等待回复,
+// Start 返回的结果中不包含删除的目标
+func (t *Tracer) Remove(target string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var found bool
+	targets := t.targets[:0]
+	for _, m := range t.targets {
+		if m.target != target {
+			targets = append(targets, m)
+			continue
+		}
+		found = true
+		if m.index >= 0 {
+			heap.Remove(&t.targetHeap, m.index)
+		}
+		for val := t.base.ev.first; val != nil; {
+			next := val.evNext
+			if val.m == m {
+				m.seqPool.Free(val.ident, val.seq)
+				m.ev.remove(val)
+			}
+			val = next
+		}
+	}
+	for i := len(targets); i < len(t.targets); i++ {
+		t.targets[i] = nil
+	}
+	t.targets = targets
+	if !found {
+		return network.ErrNotFound
+	}
+	return nil
+}
+
+// listen 每个地址族只创建一次 socket
+func (t *Tracer) listen(mode icmp2.Mode) (*Mtr, error) {
+	if c, ok := t.conns[mode]; ok {
+		return c, nil
+	}
+	b := t.base
+	c := &Mtr{
+		s:          t.s,
+		seqPool:    b.seqPool,
+		ev:         b.ev,
+		mode:       mode,
+		protocol:   b.protocol,
+		port:       b.port,
+		paris:      b.paris,
+		socketType: b.socketType,
+		dataSize:   b.dataSize,
+		ident:      b.ident,
+		buffer:     make([]byte, 4096),
+	}
+	if err := c.listen(); err != nil {
+		c.closeSockets()
+		return nil, err
+	}
+	t.conns[mode] = c
+	return c, nil
+}
+
+// Close 释放 socket, 如果正在运行, 同 Stop 一样由 Start 释放 socket
+func (t *Tracer) Close() error {
+	if atomic.LoadInt32(&t.startingFlag) == 1 {
+		if err := t.Stop(); err != nil && err != network.ErrAlreadyClosed {
+			return err
+		}
+		return nil
+	}
+	return t.close()
+}
+
+func (t *Tracer) close() (err error) {
+	for mode, c := range t.conns {
+		if cErr := c.closeSockets(); cErr != nil {
+			err = cErr
+		}
+		delete(t.conns, mode)
+	}
+	if cErr := t.s.Close(); cErr != nil {
+		err = cErr
+	}
+	return
+}
+
+// Stop 可以在其它 goroutine 中调用, Start 会返回已经完成的结果
+func (t *Tracer) Stop() error {
+	if atomic.LoadInt32(&t.startingFlag) != 1 {
+		return network.ErrNotRunning
+	}
+	if !atomic.CompareAndSwapInt32(&t.closeFlag, 0, 1) {
+		return network.ErrAlreadyClosed
+	}
+	t.s.Wakeup()
+	return nil
+}
+
+func (t *Tracer) isClosing() bool {
+	return atomic.LoadInt32(&t.closeFlag) == 1
+}
+
+func (t *Tracer) Start() ([]*Result, error) {
+	return t.StartContext(context.Background())
+}
+
+// StartContext 所有目标都完成之后返回, 结果按 Add 的顺序,
+// ctx 取消或者超时的时候停止发包, 返回已经完成的结果和 ctx.Err()
+func (t *Tracer) StartContext(ctx context.Context) ([]*Result, error) {
+	if atomic.SwapInt32(&t.startingFlag, 1) == 1 {
+		return nil, network.ErrAlreadyRunning
+	}
+	defer t.close()
+	if err := t.s.EnableWakeup(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.Stop()
+			case <-done:
+			}
+		}()
+	}
+	t.mu.Lock()
+	t.ctx = ctx
+	now := time.Now()
+	for _, m := range t.targets {
+		m.begin(now)
+		if m.enrich != nil {
+			m.enrich.ctx = ctx
+		}
+	}
+	t.run()
+
+	var err error
+	if !atomic.CompareAndSwapInt32(&t.closeFlag, 0, 1) {
+		err = network.ErrAlreadyClosed
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	// 等待 PTR 和 ASN 查询的时候不持有锁, 不阻塞其它 goroutine 的 Add/Remove/Stop
+	targets := append([]*Mtr(nil), t.targets...)
+	t.mu.Unlock()
+	results := make([]*Result, len(targets))
+	for i, m := range targets {
+		results[i] = m.finalResult()
+	}
+	return results, err
+}
+
+func (t *Tracer) run() {
+	var waitTime time.Duration
+	ev := t.base.ev
+	for !t.isClosing() && (t.targetHeap.Len() != 0 || ev.first != nil) {
+		now := time.Now()
+		t.base.expire(now)
+		if t.targetHeap.Len() == 0 && ev.first == nil {
+			// 最后的探测包刚刚超时
+			break
+		}
+		// 没有需要发送的目标的时候, 只等待已经发送的探测包
+		waitTime = time.Second
+		if t.targetHeap.Len() != 0 {
+			m := t.targetHeap.Peek().(*Mtr)
+			next, ok := m.nextSend(now)
+			if !ok {
+				heap.Remove(&t.targetHeap, m.index)
+				m.finish()
+				continue
+			}
+			if g := t.lastSendTime.Add(t.interval); g.After(next) {
+				// 全局限速
+				next = g
+			}
+			if waitTime = next.Sub(now); waitTime <= 0 {
+				t.lastSendTime = now
+				m.step(now)
+				m.sendAt, _ = m.nextSend(now)
+				heap.Fix(&t.targetHeap, m.index)
+				waitTime = t.interval
+			}
+		}
+		if ev.first != nil {
+			if d := ev.first.evTime.Sub(time.Now()); d < waitTime {
+				waitTime = d
+			}
+		}
+		if waitTime < 0 {
+			waitTime = 0
+		}
+		t.drain(waitTime)
+	}
+	for t.targetHeap.Len() != 0 {
+		heap.Pop(&t.targetHeap).(*Mtr).finish()
+	}
+}
+
+// drain 在 waitTime 内接收所有的回复
+func (t *Tracer) drain(waitTime time.Duration) {
+	for !t.isClosing() {
+		if w, _ := t.waitForReply(waitTime); !w {
+			break
+		}
+		waitTime = 0
+	}
+}
+
+func (t *Tracer) waitForReply(waitTime time.Duration) (bool, error) {
+	// 等待的时候允许 Add
+	t.mu.Unlock()
+	s, err := t.s.CanRead(waitTime)
+	t.mu.Lock()
+	if err != nil {
+		return false, err
+	}
+	if s == nil {
+		return false, nil
+	}
+	for _, c := range t.conns {
+		if c.owns(s.Fd()) {
+			return c.read(s)
+		}
+	}
+	return false, nil
+}
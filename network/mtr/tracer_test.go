@@ -0,0 +1,326 @@
+package mtr
+
+import (
+	"container/heap"
+	"context"
+	"github.com/neo-hu/network-probe-tool/network"
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTracer ipv4 的 socket 是无效的 fd, 发送会失败, 回复通过共享 socket 的 timeExceeded 和 echoReply 模拟
+func newTestTracer(t *testing.T, opts ...TracerOption) (*Tracer, *Mtr) {
+	tr := NewTracer(opts...)
+	b := tr.base
+	c := &Mtr{
+		s:          tr.s,
+		seqPool:    b.seqPool,
+		ev:         b.ev,
+		mode:       icmp2.IPV4Address,
+		protocol:   b.protocol,
+		socketType: icmp2.SocketRaw,
+		ident:      b.ident,
+		socketFd:   -1,
+		sendFd:     -1,
+		errQueueFd: -1,
+		buffer:     make([]byte, 4096),
+	}
+	tr.conns[icmp2.IPV4Address] = c
+	t.Cleanup(func() { tr.Close() })
+	return tr, c
+}
+
+func (t *Tracer) target(target string) *Mtr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range t.targets {
+		if m.target == target {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestTracerDispatch(t *testing.T) {
+	tr, c := newTestTracer(t, TracerTargetOption(MaxTTLOption(2), CountOption(1)))
+	for _, target := range []string{"127.0.0.1", "127.0.0.2"} {
+		if err := tr.Add(target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m1, m2 := tr.target("127.0.0.1"), tr.target("127.0.0.2")
+	if m1.seqPool != m2.seqPool || m1.ev != m2.ev {
+		t.Fatal("targets do not share seqPool and ev")
+	}
+	now := time.Now()
+	m1.step(now)
+	m2.step(now)
+	m2.step(now)
+	probe := func(m *Mtr, ttl int) *seqValue {
+		for val := c.ev.first; val != nil; val = val.evNext {
+			if val.m == m && val.ttl == ttl {
+				return val
+			}
+		}
+		t.Fatalf("%s: no probe for ttl %d", m.target, ttl)
+		return nil
+	}
+	p1, p2, p3 := probe(m1, 1), probe(m2, 1), probe(m2, 2)
+	if p1.seq == p2.seq || p2.seq == p3.seq {
+		t.Fatalf("seq = %d, %d, %d, want unique", p1.seq, p2.seq, p3.seq)
+	}
+
+	hop := net.ParseIP("10.0.0.1")
+	c.timeExceeded(hop, p2.ident, p2.seq, nil)
+	if m2.result[1].reply != 1 || m1.result[1].reply != 0 {
+		t.Fatalf("reply = %d/%d, want time exceeded on 127.0.0.2", m1.result[1].reply, m2.result[1].reply)
+	}
+	c.echoReply(m2.ip, p3.ident, p3.seq)
+	c.echoReply(m1.ip, p1.ident, p1.seq)
+	if m1.result[1].reply != 1 || m2.result[2].reply != 1 {
+		t.Fatalf("reply = %d/%d, want echo reply on both", m1.result[1].reply, m2.result[2].reply)
+	}
+	if c.ev.first != nil {
+		t.Fatal("ev is not empty")
+	}
+	// 重复的回复
+	c.echoReply(m1.ip, p1.ident, p1.seq)
+	if m1.result[1].reply != 1 {
+		t.Fatalf("duplicate reply counted, reply = %d", m1.result[1].reply)
+	}
+	r1, r2 := m1.buildResult(-1), m2.buildResult(-1)
+	if len(r1.TTL) != 1 || !r1.TTL[0].Entries[0].IP.Equal(m1.ip) {
+		t.Fatalf("127.0.0.1: %+v", r1.TTL)
+	}
+	if len(r2.TTL) != 2 || !r2.TTL[0].Entries[0].IP.Equal(hop) || !r2.TTL[1].Entries[0].IP.Equal(m2.ip) {
+		t.Fatalf("127.0.0.2: %+v", r2.TTL)
+	}
+}
+
+func TestTracerRateLimit(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	tr, _ := newTestTracer(t, TracerIntervalOption(interval),
+		TracerTargetOption(MaxTTLOption(3), CountOption(1), IntervalOption(0), TimeoutOption(interval)))
+	targets := []string{"127.0.0.1", "127.0.0.2"}
+	for _, target := range targets {
+		if err := tr.Add(target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := tr.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []time.Time
+	for i, result := range results {
+		if result.Target != targets[i] || len(result.TTL) != 3 {
+			t.Fatalf("result %d: target = %s, ttl = %d", i, result.Target, len(result.TTL))
+		}
+		m := tr.target(targets[i])
+		for ttl := 1; ttl <= 3; ttl++ {
+			for _, e := range m.result[ttl].entries {
+				times = append(times, e.t)
+			}
+		}
+	}
+	if len(times) != 6 {
+		t.Fatalf("sent %d probes, want 6", len(times))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < interval {
+			t.Fatalf("probe %d sent %s after the previous one, want >= %s", i, d, interval)
+		}
+	}
+}
+
+func TestTargetHeap(t *testing.T) {
+	base := time.Now()
+	var th TargetHeap
+	var targets []*Mtr
+	for _, d := range []int{5, 1, 4, 2, 3} {
+		m := &Mtr{sendAt: base.Add(time.Duration(d) * time.Second), index: -1}
+		targets = append(targets, m)
+		heap.Push(&th, m)
+	}
+	for i, m := range th {
+		if m.index != i {
+			t.Fatalf("index = %d, want %d", m.index, i)
+		}
+	}
+	if m := th.Peek().(*Mtr); m != targets[1] {
+		t.Fatalf("peek sendAt = %s, want 1s", m.sendAt.Sub(base))
+	}
+	// 更新发送时间之后重新排序
+	targets[1].sendAt = base.Add(6 * time.Second)
+	heap.Fix(&th, targets[1].index)
+	heap.Remove(&th, targets[3].index)
+	if targets[3].index != -1 {
+		t.Fatalf("removed index = %d, want -1", targets[3].index)
+	}
+	var got []time.Duration
+	for th.Len() != 0 {
+		got = append(got, heap.Pop(&th).(*Mtr).sendAt.Sub(base))
+	}
+	want := []time.Duration{3 * time.Second, 4 * time.Second, 5 * time.Second, 6 * time.Second}
+	if len(got) != len(want) {
+		t.Fatalf("pop = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pop = %v, want %v", got, want)
+		}
+	}
+	if th.Peek() != nil {
+		t.Fatal("peek of empty heap != nil")
+	}
+}
+
+func TestTracerAddConflict(t *testing.T) {
+	tr, _ := newTestTracer(t, TracerTargetOption(ProtocolOption(ProtocolUDP), PortOption(40000)))
+	tests := []struct {
+		opts []Option
+		err  string // 空表示成功
+	}{
+		{nil, ""},
+		{[]Option{MaxTTLOption(5), CountOption(1)}, ""},
+		{[]Option{ProtocolOption(ProtocolICMP)}, "protocol"},
+		{[]Option{PortOption(33434)}, "port"},
+		{[]Option{ParisOption()}, "paris"},
+		{[]Option{SocketTypeOption(icmp2.SocketDgram)}, "socket type"},
+		{[]Option{IdentOption(1)}, "ident"},
+	}
+	for _, tt := range tests {
+		m, err := newMtr("127.0.0.1", append(append([]Option(nil), tr.opts...), tt.opts...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := tr.conflict(m)
+		if got == "" && tt.err != "" || !strings.Contains(got, tt.err) {
+			t.Fatalf("conflict = %q, want %q", got, tt.err)
+		}
+	}
+	if err := tr.Add("127.0.0.1", ProtocolOption(ProtocolICMP)); err == nil || !strings.Contains(err.Error(), "protocol") {
+		t.Fatalf("Add err = %v, want protocol conflict", err)
+	}
+	if len(tr.targets) != 0 {
+		t.Fatalf("targets = %d, want 0", len(tr.targets))
+	}
+}
+
+func TestTracerAddRemoveRunning(t *testing.T) {
+	tr, c := newTestTracer(t, TracerTargetOption(MaxTTLOption(2), IntervalOption(time.Millisecond), TimeoutOption(20*time.Millisecond)))
+	if err := tr.Add("127.0.0.1", ContinuousOption(), RoundIntervalOption(5*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Remove("127.0.0.9"); err != network.ErrNotFound {
+		t.Fatalf("Remove unknown target err = %v, want ErrNotFound", err)
+	}
+	type startResult struct {
+		results []*Result
+		err     error
+	}
+	done := make(chan startResult, 1)
+	go func() {
+		results, err := tr.Start()
+		done <- startResult{results, err}
+	}()
+	time.Sleep(30 * time.Millisecond)
+	if err := tr.Add("127.0.0.2", CountOption(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Remove("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	// 删除的目标没有等待回复的探测包
+	tr.mu.Lock()
+	for val := c.ev.first; val != nil; val = val.evNext {
+		if val.m.target == "127.0.0.1" {
+			tr.mu.Unlock()
+			t.Fatal("removed target still has pending probes")
+		}
+	}
+	tr.mu.Unlock()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if len(r.results) != 1 || r.results[0].Target != "127.0.0.2" {
+			t.Fatalf("results = %v, want only 127.0.0.2", r.results)
+		}
+		if tr := r.results[0].TTL; len(tr) != 2 || tr[0].Sent != 2 || tr[1].Sent != 2 {
+			t.Fatalf("ttl = %+v, want 2 probes per hop", tr)
+		}
+	case <-time.After(5 * time.Second):
+		tr.Stop()
+		t.Fatal("Start did not return after the continuous target was removed")
+	}
+	if err := tr.Add("127.0.0.3"); err != network.ErrAlreadyClosed {
+		t.Fatalf("Add after Start err = %v, want ErrAlreadyClosed", err)
+	}
+}
+
+// blockingASN 查询在 release 关闭之前不返回
+type blockingASN struct {
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingASN) LookupASN(ctx context.Context, ip net.IP) (*ASN, error) {
+	close(b.called)
+	<-b.release
+	return &ASN{Number: 64512}, nil
+}
+
+func TestTracerEnrichUnlocked(t *testing.T) {
+	provider := &blockingASN{called: make(chan struct{}), release: make(chan struct{})}
+	tr, c := newTestTracer(t, TracerTargetOption(MaxTTLOption(1), CountOption(1), TimeoutOption(time.Second), ASNOption(provider)))
+	if err := tr.Add("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []*Result, 1)
+	go func() {
+		results, _ := tr.Start()
+		done <- results
+	}()
+	// 模拟目的地址的回复
+	for replied := false; !replied; time.Sleep(time.Millisecond) {
+		tr.mu.Lock()
+		if val := c.ev.first; val != nil {
+			c.echoReply(val.m.ip, val.ident, val.seq)
+			replied = true
+		}
+		tr.mu.Unlock()
+	}
+	tr.s.Wakeup()
+	select {
+	case <-provider.called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LookupASN was not called")
+	}
+	removed := make(chan error, 1)
+	go func() { removed <- tr.Remove("127.0.0.1") }()
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		close(provider.release)
+		t.Fatal("Remove blocked while waiting for the ASN lookup")
+	}
+	close(provider.release)
+	results := <-done
+	if len(results) != 1 || len(results[0].TTL) != 1 {
+		t.Fatalf("results = %v", results)
+	}
+	if hosts := results[0].TTL[0].Hosts; len(hosts) != 1 || hosts[0].ASN == nil || hosts[0].ASN.Number != 64512 {
+		t.Fatalf("hosts = %+v, want AS64512", hosts)
+	}
+}
@@ -0,0 +1,114 @@
+package mtr
+
+import (
+	"fmt"
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type UnreachableReason int
+
+const (
+	UnreachableOther         UnreachableReason = iota
+	UnreachableNetwork                         // 没有到目的网络的路由
+	UnreachableHost                            // 目的主机不可达
+	UnreachableProtocol                        // 目的主机不支持探测的协议
+	UnreachablePort                            // 目的端口不可达
+	UnreachableFragmentation                   // 需要分片 (ipv4) or 包太大 (ipv6), 见 MTU
+	UnreachableProhibited                      // 防火墙或者 acl 拒绝
+)
+
+func (r UnreachableReason) String() string {
+	switch r {
+	case UnreachableNetwork:
+		return "network unreachable"
+	case UnreachableHost:
+		return "host unreachable"
+	case UnreachableProtocol:
+		return "protocol unreachable"
+	case UnreachablePort:
+		return "port unreachable"
+	case UnreachableFragmentation:
+		return "fragmentation needed"
+	case UnreachableProhibited:
+		return "administratively prohibited"
+	}
+	return "unreachable"
+}
+
+// Unreachable 路由器或者目的地址返回的 Destination Unreachable (ipv6 还包括 Packet Too Big)
+type Unreachable struct {
+	Type   int // icmp type
+	Code   int // icmp code
+	MTU    int // 下一跳的 mtu, 只有 UnreachableFragmentation 有
+	Reason UnreachableReason
+}
+
+func newUnreachable(mode icmp2.Mode, typ, code, mtu int) *Unreachable {
+	u := &Unreachable{Type: typ, Code: code}
+	if mode == icmp2.IPV6Address {
+		if typ == int(ipv6.ICMPTypePacketTooBig) {
+			u.Reason, u.MTU = UnreachableFragmentation, mtu
+			return u
+		}
+		switch code {
+		case 0:
+			u.Reason = UnreachableNetwork
+		case 1, 5, 6:
+			// 1: administratively prohibited, 5: source address failed ingress/egress policy, 6: reject route
+			u.Reason = UnreachableProhibited
+		case 3:
+			u.Reason = UnreachableHost
+		case 4:
+			u.Reason = UnreachablePort
+		}
+		return u
+	}
+	switch code {
+	case 0, 6, 11:
+		u.Reason = UnreachableNetwork
+	case 1, 7, 12:
+		u.Reason = UnreachableHost
+	case 2:
+		u.Reason = UnreachableProtocol
+	case 3:
+		u.Reason = UnreachablePort
+	case 4:
+		u.Reason, u.MTU = UnreachableFragmentation, mtu
+	case 9, 10, 13:
+		u.Reason = UnreachableProhibited
+	}
+	return u
+}
+
+// Prohibited 被防火墙拒绝, 而不是丢包
+func (u *Unreachable) Prohibited() bool {
+	return u.Reason == UnreachableProhibited
+}
+
+// String 同 traceroute 的标记, 例如 !H, !X, !F-1400
+func (u *Unreachable) String() string {
+	switch u.Reason {
+	case UnreachableNetwork:
+		return "!N"
+	case UnreachableHost:
+		return "!H"
+	case UnreachableProtocol:
+		return "!P"
+	case UnreachablePort:
+		return "!p"
+	case UnreachableFragmentation:
+		return fmt.Sprintf("!F-%d", u.MTU)
+	case UnreachableProhibited:
+		return "!X"
+	}
+	return fmt.Sprintf("!<%d>", u.Code)
+}
+
+func isDestUnreachable(mode icmp2.Mode, typ int) bool {
+	if mode == icmp2.IPV6Address {
+		return typ == int(ipv6.ICMPTypeDestinationUnreachable) || typ == int(ipv6.ICMPTypePacketTooBig)
+	}
+	return typ == int(ipv4.ICMPTypeDestinationUnreachable)
+}
@@ -0,0 +1,62 @@
+package mtr
+
+import (
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"testing"
+)
+
+func TestNewUnreachable(t *testing.T) {
+	tests := []struct {
+		mode       icmp2.Mode
+		typ, code  int
+		mtu        int
+		reason     UnreachableReason
+		wantMTU    int
+		str        string
+		prohibited bool
+	}{
+		{icmp2.IPV4Address, 3, 0, 0, UnreachableNetwork, 0, "!N", false},
+		{icmp2.IPV4Address, 3, 1, 0, UnreachableHost, 0, "!H", false},
+		{icmp2.IPV4Address, 3, 2, 0, UnreachableProtocol, 0, "!P", false},
+		{icmp2.IPV4Address, 3, 3, 0, UnreachablePort, 0, "!p", false},
+		{icmp2.IPV4Address, 3, 4, 1400, UnreachableFragmentation, 1400, "!F-1400", false},
+		{icmp2.IPV4Address, 3, 5, 0, UnreachableOther, 0, "!<5>", false},
+		{icmp2.IPV4Address, 3, 6, 0, UnreachableNetwork, 0, "!N", false},
+		{icmp2.IPV4Address, 3, 7, 0, UnreachableHost, 0, "!H", false},
+		{icmp2.IPV4Address, 3, 9, 0, UnreachableProhibited, 0, "!X", true},
+		{icmp2.IPV4Address, 3, 10, 0, UnreachableProhibited, 0, "!X", true},
+		{icmp2.IPV4Address, 3, 11, 0, UnreachableNetwork, 0, "!N", false},
+		{icmp2.IPV4Address, 3, 12, 0, UnreachableHost, 0, "!H", false},
+		{icmp2.IPV4Address, 3, 13, 0, UnreachableProhibited, 0, "!X", true},
+		// mtu 只在 frag needed 的时候有效
+		{icmp2.IPV4Address, 3, 1, 1400, UnreachableHost, 0, "!H", false},
+		{icmp2.IPV6Address, 1, 0, 0, UnreachableNetwork, 0, "!N", false},
+		{icmp2.IPV6Address, 1, 1, 0, UnreachableProhibited, 0, "!X", true},
+		{icmp2.IPV6Address, 1, 2, 0, UnreachableOther, 0, "!<2>", false},
+		{icmp2.IPV6Address, 1, 3, 0, UnreachableHost, 0, "!H", false},
+		{icmp2.IPV6Address, 1, 4, 0, UnreachablePort, 0, "!p", false},
+		{icmp2.IPV6Address, 1, 5, 0, UnreachableProhibited, 0, "!X", true},
+		{icmp2.IPV6Address, 1, 6, 0, UnreachableProhibited, 0, "!X", true},
+		// Packet Too Big
+		{icmp2.IPV6Address, 2, 0, 1280, UnreachableFragmentation, 1280, "!F-1280", false},
+	}
+	for _, tt := range tests {
+		u := newUnreachable(tt.mode, tt.typ, tt.code, tt.mtu)
+		if u.Type != tt.typ || u.Code != tt.code || u.Reason != tt.reason || u.MTU != tt.wantMTU {
+			t.Errorf("newUnreachable(%d, %d, %d, %d) = %+v, want reason %v mtu %d", tt.mode, tt.typ, tt.code, tt.mtu, u, tt.reason, tt.wantMTU)
+		}
+		if s := u.String(); s != tt.str {
+			t.Errorf("newUnreachable(%d, %d, %d, %d).String() = %q, want %q", tt.mode, tt.typ, tt.code, tt.mtu, s, tt.str)
+		}
+		if u.Prohibited() != tt.prohibited {
+			t.Errorf("newUnreachable(%d, %d, %d, %d).Prohibited() = %v", tt.mode, tt.typ, tt.code, tt.mtu, u.Prohibited())
+		}
+		if !isDestUnreachable(tt.mode, tt.typ) {
+			t.Errorf("isDestUnreachable(%d, %d) = false", tt.mode, tt.typ)
+		}
+	}
+	// Time Exceeded 不是
+	if isDestUnreachable(icmp2.IPV4Address, 11) || isDestUnreachable(icmp2.IPV6Address, 3) {
+		t.Errorf("isDestUnreachable(time exceeded) = true")
+	}
+}
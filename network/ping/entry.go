@@ -1,8 +1,10 @@
 package ping
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/neo-hu/network-probe-tool/network"
 	"github.com/neo-hu/network-probe-tool/pkg/icmp"
 	"math"
 	"net"
@@ -25,6 +27,8 @@ const (
 type reply struct {
 	elapsed  time.Duration
 	sendTime time.Time
+	ident    uint16
+	seq      uint16
 }
 
 type entry struct {
@@ -33,10 +37,15 @@ type entry struct {
 	sa   syscall.Sockaddr
 	mode icmp.Mode
 
-	dataSize int
-	count    int
-	timeout  time.Duration
-	interval time.Duration
+	family       family
+	allAddresses bool
+	resolveTime  time.Duration // 解析域名的耗时
+
+	dataSize   int
+	count      int
+	continuous bool // 一直 ping, 忽略 count
+	timeout    time.Duration
+	interval   time.Duration
 
 	evTime time.Time
 	index  int
@@ -44,7 +53,10 @@ type entry struct {
 	recv   int
 	typ    EVType
 
-	result []*reply
+	result  []*reply
+	pending int // result 中第一个还没有回复也没有超时的包
+
+	err *Error // 解析或者创建 socket 失败的时候不发包, 发送失败的时候是最后一次的错误
 
 	// dev 标准差
 	oldMean float64
@@ -57,52 +69,130 @@ func (e entry) Dev() float64 {
 	}
 	return math.Sqrt(e.m2 / float64(e.recv))
 }
+
+// done 第 i 个包已经收到回复或者超时
+func (e *entry) done(i int) bool {
+	return i < e.pending || e.result[i].elapsed != ResultUnUsed
+}
+
+// prune 删除 before 之前已经完成的结果
+func (e *entry) prune(before time.Time) {
+	var n int
+	for n < len(e.result) && e.done(n) && e.result[n].sendTime.Before(before) {
+		n += 1
+	}
+	if n == 0 {
+		return
+	}
+	e.result = e.result[:copy(e.result, e.result[n:])]
+	e.pending -= n
+	if e.pending < 0 {
+		e.pending = 0
+	}
+}
+
+// window 统计最近 d 时间内已经完成的包, 还在等待回复的包不计算
+func (e *entry) window(now time.Time, d time.Duration) WindowResult {
+	w := WindowResult{Window: d}
+	start := now.Add(-d)
+	var times []time.Duration
+	for i, r := range e.result {
+		if r.sendTime.Before(start) || !e.done(i) {
+			continue
+		}
+		w.Packets += 1
+		times = append(times, r.elapsed)
+	}
+	w.Received, w.Min, w.Avg, w.Max, w.Mdev, w.Jitter = statistics(times)
+	return w
+}
+
 func (e entry) String() string {
 	return fmt.Sprintf("<entry %s[%d], send:%d>", e.host, e.index, e.send)
 }
 
-func newEntry(host string, opts ...AddressOption) (*entry, error) {
-	ns, err := net.LookupHost(host)
+type family int
+
+const (
+	familyAny        family = iota // 使用解析到的第一个地址
+	familyPreferIPv4               // 优先使用 ipv4
+	familyPreferIPv6               // 优先使用 ipv6
+	familyIPv4                     // 只使用 ipv4
+	familyIPv6                     // 只使用 ipv6
+)
+
+// newEntries 默认只 ping 解析到的一个地址, AllAddressesOpt 的时候每个地址一个 entry
+func newEntries(r network.Resolver, host string, opts ...AddressOption) ([]*entry, error) {
+	ns, resolveTime, err := network.LookupIPAddr(context.Background(), r, host)
 	if err != nil {
 		return nil, err
 	}
-	e := &entry{host: host, dataSize: icmp.DefaultDataSize,
+	tmpl := entry{host: host, resolveTime: resolveTime, dataSize: icmp.DefaultDataSize,
 		count:    DefaultCount,
 		interval: icmp.DefaultInterval,
 		timeout:  icmp.DefaultTimeout,
 		typ:      EVPing,
 	}
-	for _, ipAddr := range ns {
-		addr := net.ParseIP(ipAddr)
-		if addr == nil {
-			err = fmt.Errorf("parse ip %q is nil", ipAddr)
-			continue
-		}
-		e.ip = addr.To4()
-		if e.ip != nil {
-			e.mode = icmp.IPV4Address
-			var sa = &syscall.SockaddrInet4{}
-			copy(sa.Addr[:], e.ip)
-			e.sa = sa
-			break
+	for _, opt := range opts {
+		opt(&tmpl)
+	}
+	var all, v4, v6 []*net.IPAddr
+	for i := range ns {
+		addr := &ns[i]
+		all = append(all, addr)
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
 		} else {
-			e.ip = addr.To16()
-			if e.ip != nil {
-				e.mode = icmp.IPV4Address
-				var sa = &syscall.SockaddrInet6{}
-				copy(sa.Addr[:], e.ip)
-				e.sa = sa
-				break
-			}
+			v6 = append(v6, addr)
 		}
 	}
-	if e.mode == 0 {
+	var addrs []*net.IPAddr
+	switch tmpl.family {
+	case familyIPv4:
+		addrs = v4
+	case familyIPv6:
+		addrs = v6
+	case familyPreferIPv4:
+		addrs = append(v4, v6...)
+	case familyPreferIPv6:
+		addrs = append(v6, v4...)
+	default:
+		addrs = all
+	}
+	if len(addrs) == 0 {
 		return nil, errors.New("host ip is nil")
 	}
-	for _, opt := range opts {
-		opt(e)
+	if !tmpl.allAddresses {
+		addrs = addrs[:1]
+	}
+	entries := make([]*entry, 0, len(addrs))
+	for _, addr := range addrs {
+		e := tmpl
+		e.setAddr(addr)
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+func (e *entry) setAddr(addr *net.IPAddr) {
+	if ip := addr.IP.To4(); ip != nil {
+		e.ip = ip
+		e.mode = icmp.IPV4Address
+		var sa = &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], e.ip)
+		e.sa = sa
+		return
+	}
+	e.ip = addr.IP.To16()
+	e.mode = icmp.IPV6Address
+	var sa = &syscall.SockaddrInet6{}
+	copy(sa.Addr[:], e.ip)
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
 	}
-	return e, nil
+	e.sa = sa
 }
 
 type AddressOption func(*entry)
@@ -127,6 +217,49 @@ func CountOpt(count int) AddressOption {
 		}
 	}
 }
+
+// ContinuousOpt 一直 ping 直到 Stop, 只保留最大统计窗口内的结果
+func ContinuousOpt() AddressOption {
+	return func(e *entry) {
+		e.continuous = true
+	}
+}
+
+// PreferIPv4Opt 同时有 ipv4 和 ipv6 地址的时候优先使用 ipv4
+func PreferIPv4Opt() AddressOption {
+	return func(e *entry) {
+		e.family = familyPreferIPv4
+	}
+}
+
+// PreferIPv6Opt 同时有 ipv4 和 ipv6 地址的时候优先使用 ipv6
+func PreferIPv6Opt() AddressOption {
+	return func(e *entry) {
+		e.family = familyPreferIPv6
+	}
+}
+
+// ForceIPv4Opt 只使用 ipv4 地址
+func ForceIPv4Opt() AddressOption {
+	return func(e *entry) {
+		e.family = familyIPv4
+	}
+}
+
+// ForceIPv6Opt 只使用 ipv6 地址
+func ForceIPv6Opt() AddressOption {
+	return func(e *entry) {
+		e.family = familyIPv6
+	}
+}
+
+// AllAddressesOpt ping 解析到的所有地址, 每个地址一个结果
+func AllAddressesOpt() AddressOption {
+	return func(e *entry) {
+		e.allAddresses = true
+	}
+}
+
 func DataSizeOption(size int) AddressOption {
 	return func(e *entry) {
 		if size >= 0 {
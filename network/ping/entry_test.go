@@ -0,0 +1,108 @@
+package ping
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestEntry 第 i 个包在 base + i 秒发送, rtt 为 elapsed[i], pending 之前没有回复的包已经超时
+func newTestEntry(base time.Time, pending int, elapsed ...time.Duration) *entry {
+	e := &entry{pending: pending}
+	for i, d := range elapsed {
+		e.result = append(e.result, &reply{sendTime: base.Add(time.Duration(i) * time.Second), elapsed: d})
+	}
+	return e
+}
+
+const ms = time.Millisecond
+
+func TestWindow(t *testing.T) {
+	base := time.Now()
+	// 0: 10ms, 1: 超时, 2: 30ms, 3: 发送失败, 4: 20ms, 5: 等待回复, 6: 40ms (5 之后的回复)
+	e := newTestEntry(base, 5, 10*ms, ResultUnUsed, 30*ms, ResultError, 20*ms, ResultUnUsed, 40*ms)
+	now := base.Add(6 * time.Second)
+	tests := []struct {
+		d        time.Duration
+		packets  int
+		received int
+		min      time.Duration
+		avg      time.Duration
+		max      time.Duration
+		mdev     time.Duration
+		jitter   time.Duration
+	}{
+		// 开始的时间等于发送时间的包也在窗口内
+		{0, 1, 1, 40 * ms, 40 * ms, 40 * ms, 0, 0},
+		{time.Second - 1, 1, 1, 40 * ms, 40 * ms, 40 * ms, 0, 0},
+		// 5 还在等待回复, 不计算
+		{time.Second, 1, 1, 40 * ms, 40 * ms, 40 * ms, 0, 0},
+		{2 * time.Second, 2, 2, 20 * ms, 30 * ms, 40 * ms, 10 * ms, 20 * ms},
+		// 发送失败算作丢包
+		{3 * time.Second, 3, 2, 20 * ms, 30 * ms, 40 * ms, 10 * ms, 20 * ms},
+		{4 * time.Second, 4, 3, 20 * ms, 30 * ms, 40 * ms, 8164965, 15 * ms},
+		// 超时算作丢包
+		{5 * time.Second, 5, 3, 20 * ms, 30 * ms, 40 * ms, 8164965, 15 * ms},
+		{time.Hour, 6, 4, 10 * ms, 25 * ms, 40 * ms, 11180339, 50 * ms / 3},
+	}
+	for _, tt := range tests {
+		w := e.window(now, tt.d)
+		if w.Window != tt.d || w.Packets != tt.packets || w.Received != tt.received {
+			t.Fatalf("window %s: packets = %d/%d, want %d/%d", tt.d, w.Received, w.Packets, tt.received, tt.packets)
+		}
+		if w.Min != tt.min || w.Avg != tt.avg || w.Max != tt.max || w.Jitter != tt.jitter {
+			t.Fatalf("window %s: min/avg/max/jitter = %v/%v/%v/%v, want %v/%v/%v/%v",
+				tt.d, w.Min, w.Avg, w.Max, w.Jitter, tt.min, tt.avg, tt.max, tt.jitter)
+		}
+		if d := w.Mdev - tt.mdev; d < -1 || d > 1 {
+			t.Fatalf("window %s: mdev = %d, want %d", tt.d, w.Mdev, tt.mdev)
+		}
+		if loss := float64(tt.packets-tt.received) * 100 / float64(tt.packets); w.Loss() != loss {
+			t.Fatalf("window %s: loss = %.2f, want %.2f", tt.d, w.Loss(), loss)
+		}
+	}
+	// 只有等待回复的包
+	if w := newTestEntry(base, 0, ResultUnUsed).window(now, time.Hour); w.Packets != 0 || w.Received != 0 || w.Loss() != 0 {
+		t.Fatalf("window of pending packet = %+v", w)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	base := time.Now()
+	tests := []struct {
+		name    string
+		pending int
+		elapsed []time.Duration
+		before  time.Duration // 相对 base
+		left    int           // 剩下的包
+		newPend int
+		done    []bool // 剩下的包是否已经完成
+	}{
+		{"nothing before", 2, []time.Duration{10 * ms, ResultUnUsed, ResultUnUsed}, 0, 3, 2, []bool{true, true, false}},
+		// before 等于发送时间的包不删除
+		{"boundary", 2, []time.Duration{10 * ms, ResultUnUsed, ResultUnUsed}, time.Second, 2, 1, []bool{true, false}},
+		{"timeouts", 2, []time.Duration{10 * ms, ResultUnUsed, ResultUnUsed}, 2 * time.Second, 1, 0, []bool{false}},
+		// 在等待回复的包停止, 之后的回复不删除
+		{"stop at pending", 1, []time.Duration{ResultError, ResultUnUsed, 20 * ms}, time.Hour, 2, 0, []bool{false, true}},
+		// pending 之后已经收到回复的包也删除, pending 不小于 0
+		{"replies after pending", 1, []time.Duration{10 * ms, 20 * ms, 30 * ms, ResultUnUsed}, time.Hour, 1, 0, []bool{false}},
+		{"all done", 3, []time.Duration{10 * ms, ResultUnUsed, ResultError}, time.Hour, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEntry(base, tt.pending, tt.elapsed...)
+			last := e.result[len(e.result)-1]
+			e.prune(base.Add(tt.before))
+			if len(e.result) != tt.left || e.pending != tt.newPend {
+				t.Fatalf("left = %d, pending = %d, want %d, %d", len(e.result), e.pending, tt.left, tt.newPend)
+			}
+			for i, done := range tt.done {
+				if e.done(i) != done {
+					t.Fatalf("done(%d) = %v, want %v", i, !done, done)
+				}
+			}
+			if tt.left > 0 && e.result[len(e.result)-1] != last {
+				t.Fatal("pruned from the end")
+			}
+		})
+	}
+}
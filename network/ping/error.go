@@ -0,0 +1,37 @@
+package ping
+
+import "fmt"
+
+type ErrorKind int
+
+const (
+	ErrorResolve ErrorKind = iota + 1 // 解析域名失败
+	ErrorSocket                       // 创建 socket 失败
+	ErrorSend                         // 发送失败
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorResolve:
+		return "resolve"
+	case ErrorSocket:
+		return "socket"
+	case ErrorSend:
+		return "send"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// Error 目标的错误, 记录在 Result.Err 中
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
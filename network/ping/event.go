@@ -0,0 +1,56 @@
+package ping
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventSend      EventType = iota // 发送了一个 echo 请求
+	EventReply                      // 收到 echo 回复
+	EventTimeout                    // 超时没有收到回复
+	EventSendError                  // 发送失败
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSend:
+		return "send"
+	case EventReply:
+		return "reply"
+	case EventTimeout:
+		return "timeout"
+	case EventSendError:
+		return "send error"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+type Event struct {
+	Type  EventType
+	Host  string
+	IP    net.IP
+	Ident uint16
+	Seq   uint16
+	TTL   int           // 回复报文的 ttl, 只有 EventReply 有效
+	RTT   time.Duration // 只有 EventReply 有效
+	Time  time.Time
+	Err   error // 只有 EventSendError 有效
+}
+
+func (ev Event) String() string {
+	switch ev.Type {
+	case EventReply:
+		return fmt.Sprintf("[%s(%s)] reply ident=%d seq=%d ttl=%d time=%v", ev.Host, ev.IP, ev.Ident, ev.Seq, ev.TTL, ev.RTT)
+	case EventSendError:
+		return fmt.Sprintf("[%s(%s)] send error ident=%d seq=%d: %v", ev.Host, ev.IP, ev.Ident, ev.Seq, ev.Err)
+	}
+	return fmt.Sprintf("[%s(%s)] %s ident=%d seq=%d", ev.Host, ev.IP, ev.Type, ev.Ident, ev.Seq)
+}
+
+// EventHandler 在 Start 所在的 goroutine 中按顺序调用, 不要阻塞. 调用的时候不持有 Ping 的锁,
+// 可以调用 Add/Remove/Update/Snapshot/Stop, 事件在等待回复之前统一调用, 不是在包发送或者收到的时刻调用, 时间使用 Event.Time
+type EventHandler func(Event)
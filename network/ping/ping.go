@@ -2,6 +2,7 @@ package ping
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
 	"github.com/neo-hu/network-probe-tool/network"
 	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
@@ -11,6 +12,7 @@ import (
 	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 	"os"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -25,14 +27,30 @@ type Ping struct {
 	ipv6Fd int
 	s      *_select.Select
 
+	socketType icmp2.SocketType
+	ipv4Type   icmp2.SocketType // 实际使用的 socket 类型
+	ipv6Type   icmp2.SocketType
+
+	// mu 保护 entries/entryHeap/seqPool, Start 只有在等待回复的时候才会释放
+	mu sync.Mutex
+
 	ident        int
 	interval     time.Duration
+	windows      []time.Duration
+	keepAlive    bool
+	tolerant     bool
+	resolver     network.Resolver
 	entryHeap    EntryHeap
 	entries      []*entry
 	startingFlag int32
 	closeFlag    int32
 
 	buffer []byte
+	oob    []byte
+
+	handler    EventHandler
+	events     []Event   // 持有 mu 的时候产生的事件, 释放 mu 之后再调用 handler
+	nextExpire time.Time // 最近一个包的超时时间
 
 	seqPool *icmp2.SeqPool
 	//seq    int
@@ -53,11 +71,55 @@ func IntervalOption(interval time.Duration) Option {
 	}
 }
 
+// WindowsOption 滚动统计的时间窗口, 持续 ping (ContinuousOpt) 默认 DefaultWindows
+func WindowsOption(windows ...time.Duration) Option {
+	return func(ping *Ping) {
+		ping.windows = windows
+	}
+}
+
+// KeepAliveOption 所有目标都完成之后 Start 不返回, 等待 Add 新的目标, 直到 Stop
+func KeepAliveOption() Option {
+	return func(ping *Ping) {
+		ping.keepAlive = true
+	}
+}
+
+// ResolverOption 解析目标使用的 Resolver, 例如 dns.NewDNS("8.8.8.8"), 默认 net.DefaultResolver
+func ResolverOption(r network.Resolver) Option {
+	return func(ping *Ping) {
+		ping.resolver = r
+	}
+}
+
+// TolerantOption 解析失败, 创建 socket 失败的时候 Add 不返回错误, 目标不发包, 错误记录在 Result.Err,
+// 其它目标继续运行
+func TolerantOption() Option {
+	return func(ping *Ping) {
+		ping.tolerant = true
+	}
+}
+
+// EventHandlerOption 每个包发送/回复/超时/发送失败的时候回调
+func EventHandlerOption(h EventHandler) Option {
+	return func(ping *Ping) {
+		ping.handler = h
+	}
+}
+
+// SocketTypeOption icmp socket 类型, 默认 icmp.SocketRaw
+func SocketTypeOption(t icmp2.SocketType) Option {
+	return func(ping *Ping) {
+		ping.socketType = t
+	}
+}
+
 func NewPing(opts ...Option) *Ping {
 	p := &Ping{
 		ident:    os.Getpid() & 0xFFFF,
 		interval: time.Millisecond,
 		buffer:   make([]byte, 4096),
+		oob:      make([]byte, 128),
 		s:        _select.NewSelect(),
 	}
 
@@ -68,33 +130,173 @@ func NewPing(opts ...Option) *Ping {
 	return p
 }
 
-func (p *Ping) Add(host string, opts ...AddressOption) error {
-	if atomic.LoadInt32(&p.startingFlag) == 1 {
-		return nil
+func (p *Ping) maxWindow() time.Duration {
+	var max time.Duration
+	for _, w := range p.windows {
+		if w > max {
+			max = w
+		}
 	}
-	e, err := newEntry(host, opts...)
+	return max
+}
+
+// Add 添加一个目标, 可以在 Start 运行的时候从其它 goroutine 调用
+func (p *Ping) Add(host string, opts ...AddressOption) error {
+	entries, err := newEntries(p.resolver, host, opts...)
 	if err != nil {
-		return err
+		if !p.tolerant {
+			return err
+		}
+		entries = []*entry{{host: host, index: -1, err: &Error{Kind: ErrorResolve, Err: err}}}
 	}
-	if e.mode == icmp2.IPV6Address {
-		if p.ipv6Fd == 0 {
-			p.ipv6Fd, err = icmp2.Listen(e.mode)
-			if err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isClosing() {
+		return network.ErrAlreadyClosed
+	}
+	for _, e := range entries {
+		if e.err != nil {
+			continue
+		}
+		if err := p.listen(e.mode); err != nil {
+			if !p.tolerant {
 				return err
 			}
-			p.s.Add(p.ipv6Fd)
+			e.err = &Error{Kind: ErrorSocket, Err: err}
 		}
-	} else {
-		if p.ipv4Fd == 0 {
-			p.ipv4Fd, err = icmp2.Listen(e.mode)
-			if err != nil {
-				return err
+	}
+	for _, e := range entries {
+		if e.err != nil {
+			// 不发包, 只记录结果, 不在 entryHeap 中
+			e.index = -1
+			p.entries = append(p.entries, e)
+			continue
+		}
+		if e.continuous && p.windows == nil {
+			p.windows = DefaultWindows
+		}
+		p.enqueue(e)
+		p.entries = append(p.entries, e)
+	}
+	if atomic.LoadInt32(&p.startingFlag) == 1 {
+		// 重新计算等待的时间
+		p.s.Wakeup()
+	}
+	return nil
+}
+
+// Remove 删除 host 对应的目标, 还没有回复的包不再等待, 结果中也不再包含这个目标
+func (p *Ping) Remove(host string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var found bool
+	entries := p.entries[:0]
+	for _, e := range p.entries {
+		if e.host != host {
+			entries = append(entries, e)
+			continue
+		}
+		found = true
+		p.remove(e)
+		for i, r := range e.result {
+			if !e.done(i) {
+				p.seqPool.Free(r.ident, r.seq)
 			}
-			p.s.Add(p.ipv4Fd)
 		}
 	}
-	p.enqueue(e)
-	p.entries = append(p.entries, e)
+	for i := len(entries); i < len(p.entries); i++ {
+		p.entries[i] = nil
+	}
+	p.entries = entries
+	if !found {
+		return network.ErrNotFound
+	}
+	return nil
+}
+
+// Update 修改 host 对应目标的配置 (count, interval, size, timeout), 可以在 Start 运行的时候调用
+func (p *Ping) Update(host string, opts ...AddressOption) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var found bool
+	now := time.Now()
+	for _, e := range p.entries {
+		if e.host != host {
+			continue
+		}
+		found = true
+		for _, opt := range opts {
+			opt(e)
+		}
+		if e.continuous && p.windows == nil {
+			p.windows = DefaultWindows
+		}
+		p.reschedule(e, now)
+	}
+	if !found {
+		return network.ErrNotFound
+	}
+	if atomic.LoadInt32(&p.startingFlag) == 1 {
+		p.s.Wakeup()
+	}
+	return nil
+}
+
+// reschedule 配置修改之后重新计算下一次发包或者结束的时间
+func (p *Ping) reschedule(e *entry, now time.Time) {
+	if e.err != nil && e.err.Kind != ErrorSend {
+		return
+	}
+	var lastSendTime time.Time
+	if len(e.result) > 0 {
+		lastSendTime = e.result[len(e.result)-1].sendTime
+	}
+	if e.continuous || e.send < e.count {
+		e.typ = EVPing
+		if !lastSendTime.IsZero() {
+			e.evTime = lastSendTime.Add(e.interval)
+		}
+	} else if e.typ == EVPing || e.index >= 0 {
+		e.typ = EVTimeout
+		e.evTime = lastSendTime.Add(e.timeout)
+	}
+	if e.index >= 0 {
+		heap.Fix(&p.entryHeap, e.index)
+	} else if e.typ == EVPing && atomic.LoadInt32(&p.startingFlag) == 1 {
+		// 已经完成的目标增加了 count
+		p.enqueue(e)
+	}
+}
+
+func (p *Ping) listen(mode icmp2.Mode) error {
+	var (
+		fd  *int
+		typ *icmp2.SocketType
+		err error
+	)
+	if mode == icmp2.IPV6Address {
+		fd, typ = &p.ipv6Fd, &p.ipv6Type
+	} else {
+		fd, typ = &p.ipv4Fd, &p.ipv4Type
+	}
+	if *fd != 0 {
+		return nil
+	}
+	*fd, *typ, err = icmp2.ListenSocket(mode, p.socketType)
+	if err != nil {
+		*fd = 0
+		return err
+	}
+	if err = icmp2.EnableRecvTTL(*fd, mode); err == nil && mode == icmp2.IPV6Address && *typ == icmp2.SocketRaw {
+		// raw icmpv6 socket 会收到所有的 icmpv6 报文 (邻居发现之类的)
+		err = icmp2.SetICMPv6Filter(*fd, int(ipv6.ICMPTypeEchoReply))
+	}
+	if err != nil {
+		unix.Close(*fd)
+		*fd = 0
+		return err
+	}
+	p.s.Add(*fd)
 	return nil
 }
 
@@ -106,6 +308,9 @@ func (p *Ping) dequeue() *entry {
 	return e.(*entry)
 }
 func (p *Ping) remove(e *entry) {
+	if e.index < 0 {
+		return
+	}
 	heap.Remove(&p.entryHeap, e.index)
 }
 
@@ -117,6 +322,7 @@ func (p *Ping) send(e *entry, r *reply) error {
 		err error
 	)
 	if e.mode == icmp2.IPV6Address {
+		// icmpv6 的校验和需要伪首部, 由内核计算 (RFC 3542 3.1)
 		typ = ipv6.ICMPTypeEchoRequest
 		fd = p.ipv6Fd
 	} else {
@@ -127,6 +333,7 @@ func (p *Ping) send(e *entry, r *reply) error {
 		r: r,
 		e: e,
 	})
+	r.ident, r.seq = ident, seq
 	if e.dataSize > len(p.buffer) {
 		p.buffer = make([]byte, e.dataSize)
 	}
@@ -145,11 +352,79 @@ func (p *Ping) send(e *entry, r *reply) error {
 	err = syscall.Sendto(fd, bytes, 0, e.sa)
 	if err != nil {
 		p.seqPool.Free(ident, seq)
+		return err
+	}
+	deadline := r.sendTime.Add(e.timeout)
+	if p.nextExpire.IsZero() || deadline.Before(p.nextExpire) {
+		p.nextExpire = deadline
+	}
+	return nil
+}
+
+// expire 处理已经超时的包
+func (p *Ping) expire(now time.Time) {
+	if p.nextExpire.IsZero() || p.nextExpire.After(now) {
+		return
+	}
+	p.nextExpire = time.Time{}
+	for _, e := range p.entries {
+		for e.pending < len(e.result) {
+			r := e.result[e.pending]
+			if r.elapsed != ResultUnUsed {
+				e.pending += 1
+				continue
+			}
+			deadline := r.sendTime.Add(e.timeout)
+			if deadline.After(now) {
+				if p.nextExpire.IsZero() || deadline.Before(p.nextExpire) {
+					p.nextExpire = deadline
+				}
+				break
+			}
+			// 超时之后到达的回复不再统计
+			p.seqPool.Free(r.ident, r.seq)
+			e.pending += 1
+			p.emit(EventTimeout, e, r, func(ev *Event) {
+				ev.Time = deadline
+			})
+		}
 	}
-	return err
 }
 
-func (p *Ping) Stop() (err error) {
+func (p *Ping) emit(typ EventType, e *entry, r *reply, fn func(*Event)) {
+	if p.handler == nil {
+		return
+	}
+	ev := Event{
+		Type:  typ,
+		Host:  e.host,
+		IP:    e.ip,
+		Ident: r.ident,
+		Seq:   r.seq,
+		Time:  r.sendTime,
+	}
+	if fn != nil {
+		fn(&ev)
+	}
+	p.events = append(p.events, ev)
+}
+
+// dispatch 在 Start 所在的 goroutine 中调用 handler, 调用的时候不持有 mu, handler 可以调用 Add/Remove/Snapshot/Stop
+func (p *Ping) dispatch(events []Event) {
+	for _, ev := range events {
+		p.handler(ev)
+	}
+}
+
+// takeEvents 需要持有 mu
+func (p *Ping) takeEvents() []Event {
+	events := p.events
+	p.events = nil
+	return events
+}
+
+// Stop 可以在其它 goroutine 中调用, Start 会返回已经完成的结果
+func (p *Ping) Stop() error {
 	if atomic.LoadInt32(&p.startingFlag) != 1 {
 		return network.ErrNotRunning
 	}
@@ -157,30 +432,86 @@ func (p *Ping) Stop() (err error) {
 	if !atomic.CompareAndSwapInt32(&p.closeFlag, 0, 1) {
 		return network.ErrAlreadyClosed
 	}
+	p.s.Wakeup()
+	return nil
+}
+
+// Close 释放 Add 创建的 socket, 之后 Add 返回 network.ErrAlreadyClosed.
+// 如果正在运行, 同 Stop 一样由 Start 释放 socket
+func (p *Ping) Close() error {
+	if atomic.LoadInt32(&p.startingFlag) == 1 {
+		if err := p.Stop(); err != nil && err != network.ErrAlreadyClosed {
+			return err
+		}
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	atomic.StoreInt32(&p.closeFlag, 1)
+	return p.close()
+}
 
+func (p *Ping) close() (err error) {
 	if p.ipv6Fd != 0 {
 		if cErr := unix.Close(p.ipv6Fd); cErr != nil {
 			err = cErr
 		}
+		p.ipv6Fd = 0
 	}
 	if p.ipv4Fd != 0 {
 		if cErr := unix.Close(p.ipv4Fd); cErr != nil {
 			err = cErr
 		}
+		p.ipv4Fd = 0
+	}
+	if cErr := p.s.Close(); cErr != nil {
+		err = cErr
 	}
 	return
 }
 
 func (p *Ping) Start() ([]Result, error) {
+	return p.StartContext(context.Background())
+}
+
+// StartContext ctx 取消或者超时的时候停止发包, 返回已经完成的结果和 ctx.Err()
+func (p *Ping) StartContext(ctx context.Context) ([]Result, error) {
 	if atomic.SwapInt32(&p.startingFlag, 1) == 1 {
 		return nil, network.ErrAlreadyRunning
 	}
+	defer p.close()
+	if err := p.s.EnableWakeup(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.Stop()
+			case <-done:
+			}
+		}()
+	}
+	// 在 mu 释放之后调用, 处理最后一次等待之后的事件
+	defer func() {
+		p.mu.Lock()
+		events := p.takeEvents()
+		p.mu.Unlock()
+		p.dispatch(events)
+	}()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	currentTime := time.Now()
 	var lastSendTime time.Time
 	var waitTime time.Duration
-	for !p.isClosing() && p.entryHeap.Len() != 0 {
-		e := p.entryHeap.Peek().(*entry)
-		if e.evTime.Before(currentTime) {
+	for !p.isClosing() && (p.keepAlive || p.entryHeap.Len() != 0) {
+		p.expire(currentTime)
+		if p.entryHeap.Len() == 0 {
+			goto waitForReply
+		}
+		if e := p.entryHeap.Peek().(*entry); e.evTime.Before(currentTime) {
 			if e.typ == EVPing {
 				if currentTime.Sub(lastSendTime) < p.interval {
 					// TODO 判断发送的间隔
@@ -193,12 +524,21 @@ func (p *Ping) Start() ([]Result, error) {
 					elapsed:  ResultUnUsed,
 				}
 
+				if e.continuous {
+					e.prune(lastSendTime.Add(-p.maxWindow()))
+				}
 				e.result = append(e.result, r)
 				err := p.send(e, r)
 				if err != nil {
 					r.elapsed = ResultError
+					e.err = &Error{Kind: ErrorSend, Err: err}
+					p.emit(EventSendError, e, r, func(ev *Event) {
+						ev.Err = err
+					})
+				} else {
+					p.emit(EventSend, e, r, nil)
 				}
-				if e.send < e.count {
+				if e.continuous || e.send < e.count {
 					e.typ = EVPing
 					e.evTime = lastSendTime.Add(e.interval)
 				} else {
@@ -231,9 +571,20 @@ func (p *Ping) Start() ([]Result, error) {
 					}
 				}
 			}
+		} else if p.keepAlive {
+			// 等待 Add 唤醒
+			waitTime = time.Second
 		} else {
 			waitTime = 0
 		}
+		if !p.nextExpire.IsZero() && waitTime > 0 {
+			if w := p.nextExpire.Sub(currentTime); w < waitTime {
+				waitTime = w
+				if waitTime < 0 {
+					waitTime = 0
+				}
+			}
+		}
 
 		for !p.isClosing() {
 			if w, _ := p.waitForReply(waitTime); !w {
@@ -243,28 +594,54 @@ func (p *Ping) Start() ([]Result, error) {
 		}
 		currentTime = time.Now()
 	}
-	if p.isClosing() {
-		return nil, network.ErrAlreadyClosed
+	var err error
+	if !atomic.CompareAndSwapInt32(&p.closeFlag, 0, 1) {
+		err = network.ErrAlreadyClosed
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 	}
+	return p.results(), err
+}
+
+// Snapshot 返回当前的结果, 可以在 Start 运行的时候从其它 goroutine 调用
+func (p *Ping) Snapshot() []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.results()
+}
+
+func (p *Ping) results() []Result {
+	now := time.Now()
 	results := make([]Result, len(p.entries))
 	for index, e := range p.entries {
 		rs := Result{
-			Packets:  e.send,
-			Received: e.recv,
-			IP:       e.ip,
-			Dev:      e.Dev(),
+			Packets:     e.send,
+			Received:    e.recv,
+			IP:          e.ip,
+			Dev:         e.Dev(),
+			Err:         e.err,
+			ResolveTime: e.resolveTime,
 		}
 		rs.Host = e.host
 		for _, r := range e.result {
 			rs.Times = append(rs.Times, r.elapsed)
 		}
+		for _, w := range p.windows {
+			rs.Windows = append(rs.Windows, e.window(now, w))
+		}
 		results[index] = rs
 	}
-	return results, nil
+	return results
 }
 
 func (p *Ping) waitForReply(waitTime time.Duration) (bool, error) {
+	// 等待的时候允许 Snapshot 读取结果
+	events := p.takeEvents()
+	p.mu.Unlock()
+	p.dispatch(events)
 	s, err := p.s.CanRead(waitTime)
+	p.mu.Lock()
 	if err != nil {
 		return false, err
 	}
@@ -273,16 +650,20 @@ func (p *Ping) waitForReply(waitTime time.Duration) (bool, error) {
 		return false, nil
 	}
 
-	n, ra, err := s.Read(p.buffer[:])
+	n, oobn, ra, err := s.ReadMsg(p.buffer[:], p.oob)
 	if err != nil {
 		return false, err
 	}
 	var proto int
 	var start int
+	ttl := icmp2.ParseTTL(p.oob[:oobn])
 	switch ra := ra.(type) {
 	case *syscall.SockaddrInet4:
 		proto = ipv4.ICMPType(0).Protocol()
 		_, start = icmp2.StripIPv4Header(p.buffer[:n])
+		if ttl < 0 && start > 0 {
+			ttl = int(p.buffer[8])
+		}
 	case *syscall.SockaddrInet6:
 		proto = ipv6.ICMPType(0).Protocol()
 	default:
@@ -292,8 +673,18 @@ func (p *Ping) waitForReply(waitTime time.Duration) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if m.Type != ipv4.ICMPTypeEchoReply && m.Type != ipv6.ICMPTypeEchoReply {
+		// 本机 ping 本机的时候会收到自己发送的 echo request
+		return true, nil
+	}
 	if pkt, ok := m.Body.(*icmp.Echo); ok {
-		v := p.seqPool.Free(uint16(pkt.ID), uint16(pkt.Seq))
+		var v interface{}
+		if p.isDgram(s.Fd()) {
+			// 内核改写了 ident, 只能通过 seq 匹配
+			v = p.seqPool.FreeSeq(uint16(pkt.Seq))
+		} else {
+			v = p.seqPool.Free(uint16(pkt.ID), uint16(pkt.Seq))
+		}
 		if v == nil {
 			return false, nil
 		}
@@ -309,7 +700,12 @@ func (p *Ping) waitForReply(waitTime time.Duration) (bool, error) {
 				r.e.oldMean = newMean
 			}
 			r.e.recv += 1
-			if r.e.recv >= r.e.count {
+			p.emit(EventReply, r.e, r.r, func(ev *Event) {
+				ev.Time = r.r.sendTime.Add(r.r.elapsed)
+				ev.RTT = r.r.elapsed
+				ev.TTL = ttl
+			})
+			if !r.e.continuous && r.e.recv >= r.e.count {
 				// todo 探测完成
 				p.remove(r.e)
 			}
@@ -319,6 +715,13 @@ func (p *Ping) waitForReply(waitTime time.Duration) (bool, error) {
 	return true, nil
 }
 
+func (p *Ping) isDgram(fd int) bool {
+	if fd == p.ipv6Fd {
+		return p.ipv6Type == icmp2.SocketDgram
+	}
+	return p.ipv4Type == icmp2.SocketDgram
+}
+
 func (p *Ping) isClosing() bool {
 	return atomic.LoadInt32(&p.closeFlag) == 1
 }
@@ -0,0 +1,117 @@
+package ping
+
+import (
+	"context"
+	"github.com/neo-hu/network-probe-tool/network"
+	icmp2 "github.com/neo-hu/network-probe-tool/pkg/icmp"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newSocketErrorPing ipv4 使用 pipe 代替 icmp socket, ipv6 的 socket 类型无效, 创建失败
+func newSocketErrorPing(t *testing.T) *Ping {
+	p := NewPing(TolerantOption(), SocketTypeOption(icmp2.SocketType(99)))
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	fd, err := syscall.Dup(int(r.Fd()))
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ipv4Fd = fd
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestRemoveSocketErrorEntry(t *testing.T) {
+	p := newSocketErrorPing(t)
+	if err := p.Add("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("::1"); err != nil {
+		t.Fatal(err)
+	}
+	if p.entries[1].err == nil || p.entries[1].err.Kind != ErrorSocket {
+		t.Fatalf("::1 err = %v, want socket error", p.entries[1].err)
+	}
+	if p.entries[1].index != -1 {
+		t.Fatalf("::1 index = %d, want -1", p.entries[1].index)
+	}
+	if err := p.Remove("::1"); err != nil {
+		t.Fatal(err)
+	}
+	if p.entryHeap.Len() != 1 || p.entryHeap[0].host != "127.0.0.1" {
+		t.Fatalf("entryHeap = %v, want [127.0.0.1]", p.entryHeap)
+	}
+	if len(p.entries) != 1 || p.entries[0].host != "127.0.0.1" {
+		t.Fatalf("entries = %v, want [127.0.0.1]", p.entries)
+	}
+}
+
+func TestRemoveOnlySocketErrorEntry(t *testing.T) {
+	p := newSocketErrorPing(t)
+	if err := p.Add("::1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Remove("::1"); err != nil {
+		t.Fatal(err)
+	}
+	if p.entryHeap.Len() != 0 || len(p.entries) != 0 {
+		t.Fatalf("entryHeap = %v, entries = %v, want empty", p.entryHeap, p.entries)
+	}
+}
+
+// TestEventHandlerReentrant handler 中调用 Snapshot 和 Remove 不会死锁
+func TestEventHandlerReentrant(t *testing.T) {
+	var p *Ping
+	var events []EventType
+	p = NewPing(EventHandlerOption(func(ev Event) {
+		events = append(events, ev.Type)
+		p.Snapshot()
+		if ev.Type == EventReply {
+			p.Remove(ev.Host)
+		}
+	}))
+	defer p.Close()
+	if err := p.Add("127.0.0.1", CountOpt(3), AddressIntervalOption(10*time.Millisecond), TimeoutOption(time.Second)); err != nil {
+		t.Skipf("icmp socket: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, err := p.StartContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("results = %v, want empty after Remove", results)
+	}
+	if len(events) != 2 || events[0] != EventSend || events[1] != EventReply {
+		t.Fatalf("events = %v, want [send reply]", events)
+	}
+}
+
+// TestCloseWithoutStart 没有 Start 的时候 Close 释放 Add 创建的 socket
+func TestCloseWithoutStart(t *testing.T) {
+	p := newSocketErrorPing(t)
+	if err := p.Add("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	fd := p.ipv4Fd
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if p.ipv4Fd != 0 {
+		t.Fatalf("ipv4Fd = %d, want 0", p.ipv4Fd)
+	}
+	if _, err := syscall.Dup(fd); err != syscall.EBADF {
+		t.Fatalf("dup closed fd: %v, want EBADF", err)
+	}
+	if err := p.Add("127.0.0.1"); err != network.ErrAlreadyClosed {
+		t.Fatalf("Add after Close = %v, want ErrAlreadyClosed", err)
+	}
+}
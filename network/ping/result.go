@@ -2,48 +2,107 @@ package ping
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"time"
 )
 
+var DefaultWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// Result 持续 ping (ContinuousOpt) 的时候 Packets, Received 和 Dev 是从 Start 开始的累计值,
+// Times 只保留最大的窗口内的包, 两者的统计范围不同 (String 的 min/avg/max 来自 Times), 窗口内的丢包和延迟使用 Windows
 type Result struct {
-	Host     string
-	Dev      float64
+	Host        string
+	ResolveTime time.Duration // 解析域名的耗时, Host 是 ip 的时候为 0
+	Dev         float64       // 累计
+	Packets     int           // 累计发送的包
+	Received    int           // 累计收到的回复
+	IP          net.IP
+	Times       []time.Duration // 每个包的 rtt, 没有回复为 ResultUnUsed, 发送失败为 ResultError
+	Windows     []WindowResult  // WindowsOption 配置的滚动统计
+	Err         *Error          // TolerantOption 的时候记录目标的错误
+}
+
+// WindowResult 最近 Window 时间内已经完成(收到回复或者超时)的包的统计
+type WindowResult struct {
+	Window   time.Duration
 	Packets  int
 	Received int
-	IP       net.IP
-	Times    []time.Duration
+	Min      time.Duration
+	Avg      time.Duration
+	Max      time.Duration
+	Mdev     time.Duration
+	Jitter   time.Duration // 相邻两个回复 rtt 差值的平均值
 }
 
-func (r Result) String() string {
-	var rt string
-	if r.Received > 0 {
-		var (
-			min   time.Duration
-			avg   time.Duration
-			max   time.Duration
-			sum   time.Duration
-			count time.Duration
-		)
-		for _, duration := range r.Times {
-			if duration <= 0 {
-				continue
-			}
-			sum += duration
-			count += 1
-			if min == 0 || min > duration {
-				min = duration
-			}
+func (w WindowResult) Loss() float64 {
+	var loss float64 = 0
+	if w.Packets > 0 {
+		loss = float64((w.Packets-w.Received)*100) / float64(w.Packets)
+	}
+	return loss
+}
+
+func (w WindowResult) String() string {
+	return fmt.Sprintf("%v: %d/%d packets, %.2f%% loss, min/avg/max/mdev = %v/%v/%v/%v, jitter %v",
+		w.Window, w.Received, w.Packets, w.Loss(), w.Min, w.Avg, w.Max, w.Mdev, w.Jitter)
+}
 
-			if max == 0 || max < duration {
-				max = duration
+// statistics 忽略没有收到回复的包 (<= 0)
+func statistics(times []time.Duration) (received int, min, avg, max, mdev, jitter time.Duration) {
+	var (
+		sum     time.Duration
+		sumJit  time.Duration
+		last    time.Duration
+		squares float64
+	)
+	for _, duration := range times {
+		if duration <= 0 {
+			continue
+		}
+		if received > 0 {
+			d := duration - last
+			if d < 0 {
+				d = -d
 			}
+			sumJit += d
+		}
+		last = duration
+		received += 1
+		sum += duration
+		squares += float64(duration) * float64(duration)
+		if min == 0 || min > duration {
+			min = duration
 		}
-		if count > 0 {
-			avg = max / count
+		if max == 0 || max < duration {
+			max = duration
 		}
+	}
+	if received == 0 {
+		return
+	}
+	avg = sum / time.Duration(received)
+	if v := squares/float64(received) - float64(avg)*float64(avg); v > 0 {
+		mdev = time.Duration(math.Sqrt(v))
+	}
+	if received > 1 {
+		jitter = sumJit / time.Duration(received-1)
+	}
+	return
+}
+
+func (r Result) String() string {
+	if r.Err != nil && r.Packets == 0 {
+		return fmt.Sprintf("[%s(%s)]%v", r.Host, r.IP, r.Err)
+	}
+	var rt string
+	if r.Received > 0 {
+		_, min, avg, max, _, _ := statistics(r.Times)
 		rt = fmt.Sprintf("\nround-trip min/avg/max/mdev = %v/%v/%v/%.2f", min, avg, max, r.Dev)
 	}
+	if r.Err != nil {
+		rt += fmt.Sprintf("\nlast error: %v", r.Err)
+	}
 	return fmt.Sprintf("[%s(%s)]%d packets transmitted, %d packets received, %.2f%% packet loss%s",
 		r.Host, r.IP, r.Packets, r.Received, r.Loss(), rt)
 }
@@ -0,0 +1,38 @@
+package ping
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatistics(t *testing.T) {
+	tests := []struct {
+		name     string
+		times    []time.Duration
+		received int
+		min      time.Duration
+		avg      time.Duration
+		max      time.Duration
+		mdev     time.Duration
+		jitter   time.Duration
+	}{
+		{"empty", nil, 0, 0, 0, 0, 0, 0},
+		{"lost", []time.Duration{ResultUnUsed, ResultError}, 0, 0, 0, 0, 0, 0},
+		{"single", []time.Duration{15 * ms}, 1, 15 * ms, 15 * ms, 15 * ms, 0, 0},
+		{"same", []time.Duration{15 * ms, 15 * ms, 15 * ms}, 3, 15 * ms, 15 * ms, 15 * ms, 0, 0},
+		// 丢包不影响相邻回复的 jitter
+		{"skip lost", []time.Duration{10 * ms, ResultUnUsed, 30 * ms, ResultError}, 2, 10 * ms, 20 * ms, 30 * ms, 10 * ms, 20 * ms},
+		// jitter 和顺序有关, mdev 无关
+		{"order", []time.Duration{10 * ms, 30 * ms, 10 * ms, 30 * ms}, 4, 10 * ms, 20 * ms, 30 * ms, 10 * ms, 20 * ms},
+		{"sorted", []time.Duration{10 * ms, 10 * ms, 30 * ms, 30 * ms}, 4, 10 * ms, 20 * ms, 30 * ms, 10 * ms, 20 * ms / 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received, min, avg, max, mdev, jitter := statistics(tt.times)
+			if received != tt.received || min != tt.min || avg != tt.avg || max != tt.max || mdev != tt.mdev || jitter != tt.jitter {
+				t.Fatalf("statistics = %d %v/%v/%v/%v %v, want %d %v/%v/%v/%v %v",
+					received, min, avg, max, mdev, jitter, tt.received, tt.min, tt.avg, tt.max, tt.mdev, tt.jitter)
+			}
+		})
+	}
+}
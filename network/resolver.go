@@ -0,0 +1,31 @@
+package network
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver 解析域名, net.Resolver 和 dns.DNS 都实现了这个接口
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// LookupIPAddr 通过 r 解析 host, 同时返回解析的耗时, r 为 nil 的时候使用 net.DefaultResolver,
+// host 是 ip (支持 fe80::1%eth0 这种带 zone 的地址) 的时候不需要解析, 耗时为 0
+func LookupIPAddr(ctx context.Context, r Resolver, host string) ([]net.IPAddr, time.Duration, error) {
+	literal, zone := host, ""
+	if i := strings.LastIndexByte(host, '%'); i > 0 {
+		literal, zone = host[:i], host[i+1:]
+	}
+	if ip := net.ParseIP(literal); ip != nil {
+		return []net.IPAddr{{IP: ip, Zone: zone}}, 0, nil
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	start := time.Now()
+	addrs, err := r.LookupIPAddr(ctx, host)
+	return addrs, time.Since(start), err
+}
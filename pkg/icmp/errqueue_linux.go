@@ -0,0 +1,80 @@
+// +build linux
+
+package icmp
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"unsafe"
+)
+
+const sizeofSockExtendedErr = int(unsafe.Sizeof(unix.SockExtendedErr{}))
+
+// ErrQueueSupported 普通的 udp socket 也可以通过 MSG_ERRQUEUE 读取 icmp 差错报文
+const ErrQueueSupported = true
+
+// SockError SOCK_DGRAM icmp socket 从 MSG_ERRQUEUE 中读到的 icmp 差错报文
+type SockError struct {
+	Type     uint8
+	Code     uint8
+	Info     uint32 // frag needed 时为 mtu
+	Offender net.IP // 发送差错报文的地址
+	Port     int    // 原始报文的目的端口 (udp)
+}
+
+// EnableRecvErr SOCK_DGRAM icmp socket 收不到 Time Exceeded 之类的差错报文, 需要通过 MSG_ERRQUEUE 读取
+func EnableRecvErr(fd int, m Mode) error {
+	if m == IPV6Address {
+		return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVERR, 1)
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVERR, 1)
+}
+
+// ReadErrQueue 读取一个差错报文, b 中返回原始发送的报文
+// icmp socket 从 icmp 头开始, udp socket 从 udp 的数据开始 (不包含 udp 头)
+func ReadErrQueue(fd int, b []byte) (int, *SockError, error) {
+	var oob [512]byte
+	n, oobn, _, from, err := unix.Recvmsg(fd, b, oob[:], unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	if err != nil {
+		return 0, nil, err
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, c := range cmsgs {
+		if !(c.Header.Level == unix.SOL_IP && c.Header.Type == unix.IP_RECVERR) &&
+			!(c.Header.Level == unix.SOL_IPV6 && c.Header.Type == unix.IPV6_RECVERR) {
+			continue
+		}
+		if len(c.Data) < sizeofSockExtendedErr {
+			continue
+		}
+		ee := (*unix.SockExtendedErr)(unsafe.Pointer(&c.Data[0]))
+		if ee.Origin != unix.SO_EE_ORIGIN_ICMP && ee.Origin != unix.SO_EE_ORIGIN_ICMP6 {
+			continue
+		}
+		se := &SockError{Type: ee.Type, Code: ee.Code, Info: ee.Info}
+		switch sa := from.(type) {
+		case *unix.SockaddrInet4:
+			se.Port = sa.Port
+		case *unix.SockaddrInet6:
+			se.Port = sa.Port
+		}
+		// SO_EE_OFFENDER, sockaddr 紧跟在 sock_extended_err 后面
+		sa := c.Data[sizeofSockExtendedErr:]
+		if len(sa) >= unix.SizeofSockaddrInet4 {
+			switch (*unix.RawSockaddr)(unsafe.Pointer(&sa[0])).Family {
+			case unix.AF_INET:
+				se.Offender = net.IP(append([]byte(nil), sa[4:8]...))
+			case unix.AF_INET6:
+				if len(sa) >= unix.SizeofSockaddrInet6 {
+					se.Offender = net.IP(append([]byte(nil), sa[8:24]...))
+				}
+			}
+		}
+		return n, se, nil
+	}
+	return 0, nil, errors.New("icmp error not found in errqueue")
+}
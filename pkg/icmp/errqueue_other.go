@@ -0,0 +1,29 @@
+// +build !linux
+
+package icmp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// ErrQueueSupported 普通的 udp socket 也可以通过 MSG_ERRQUEUE 读取 icmp 差错报文
+const ErrQueueSupported = false
+
+// SockError SOCK_DGRAM icmp socket 从 MSG_ERRQUEUE 中读到的 icmp 差错报文
+type SockError struct {
+	Type     uint8
+	Code     uint8
+	Info     uint32 // frag needed 时为 mtu
+	Offender net.IP // 发送差错报文的地址
+	Port     int    // 原始报文的目的端口 (udp)
+}
+
+// EnableRecvErr 非 linux 系统的 SOCK_DGRAM icmp socket 直接通过 recvfrom 返回差错报文
+func EnableRecvErr(fd int, m Mode) error {
+	return nil
+}
+
+func ReadErrQueue(fd int, b []byte) (int, *SockError, error) {
+	return 0, nil, unix.ENOPROTOOPT
+}
@@ -0,0 +1,13 @@
+package icmp
+
+import "golang.org/x/sys/unix"
+
+// SetICMPv6Filter raw icmpv6 socket 只接收 types 中的报文
+func SetICMPv6Filter(fd int, types ...int) error {
+	var f unix.ICMPv6Filter
+	// darwin 中置位表示接收
+	for _, typ := range types {
+		f.Filt[typ>>5] |= 1 << (uint32(typ) & 31)
+	}
+	return unix.SetsockoptICMPv6Filter(fd, unix.IPPROTO_ICMPV6, unix.ICMP6_FILTER, &f)
+}
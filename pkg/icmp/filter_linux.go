@@ -0,0 +1,16 @@
+package icmp
+
+import "golang.org/x/sys/unix"
+
+// SetICMPv6Filter raw icmpv6 socket 只接收 types 中的报文
+func SetICMPv6Filter(fd int, types ...int) error {
+	var f unix.ICMPv6Filter
+	// linux 中置位表示丢弃
+	for i := range f.Data {
+		f.Data[i] = 0xffffffff
+	}
+	for _, typ := range types {
+		f.Data[typ>>5] &^= 1 << (uint32(typ) & 31)
+	}
+	return unix.SetsockoptICMPv6Filter(fd, unix.IPPROTO_ICMPV6, unix.ICMPV6_FILTER, &f)
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -20,12 +21,53 @@ var (
 	IPV6Address Mode = 6
 )
 
+type SocketType int
 
+const (
+	SocketRaw   SocketType = iota // SOCK_RAW, 需要 root 或者 CAP_NET_RAW
+	SocketDgram                   // SOCK_DGRAM (linux ping_group_range), 内核会改写 echo 的 ident
+	SocketAuto                    // 优先使用 SOCK_DGRAM, 失败后回退到 SOCK_RAW
+)
+
+func (t SocketType) String() string {
+	switch t {
+	case SocketRaw:
+		return "raw"
+	case SocketDgram:
+		return "dgram"
+	case SocketAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("SocketType(%d)", int(t))
+}
 
 func Listen(m Mode) (int, error) {
+	return listen(m, SocketRaw)
+}
+
+// ListenSocket 按照 t 创建 icmp socket, 返回实际使用的 socket 类型
+func ListenSocket(m Mode, t SocketType) (int, SocketType, error) {
+	switch t {
+	case SocketRaw, SocketDgram:
+		sock, err := listen(m, t)
+		return sock, t, err
+	case SocketAuto:
+		sock, err := listen(m, SocketDgram)
+		if err == nil {
+			return sock, SocketDgram, nil
+		}
+		sock, err = listen(m, SocketRaw)
+		return sock, SocketRaw, err
+	default:
+		return 0, t, fmt.Errorf("unexpected socket type %v", t)
+	}
+}
+
+func listen(m Mode, t SocketType) (int, error) {
 	var (
 		proto  int
 		domain int
+		typ    = syscall.SOCK_RAW
 	)
 	switch m {
 	case IPV4Address:
@@ -37,15 +79,19 @@ func Listen(m Mode) (int, error) {
 	default:
 		return 0, fmt.Errorf("unexpected proto %v", m)
 	}
+	if t == SocketDgram {
+		typ = syscall.SOCK_DGRAM
+	}
 	sock, err := syscall.Socket(
 		domain,
-		syscall.SOCK_RAW,
+		typ,
 		proto,
 	)
 	if err != nil {
 		return 0, err
 	}
 	if err := unix.SetNonblock(sock, true); err != nil {
+		unix.Close(sock)
 		return 0, err
 	}
 	return sock, err
@@ -61,3 +107,33 @@ func StripIPv4Header(b []byte) (net.IP, int) {
 	src := net.IPv4(b[12], b[13], b[14], b[15])
 	return src, l
 }
+
+// EnableRecvTTL 接收报文的时候通过 oob 返回 ttl (ipv6 为 hop limit)
+func EnableRecvTTL(fd int, m Mode) error {
+	if m == IPV6Address {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, sysIPV6_RECVHOPLIMIT, 1)
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTTL, 1)
+}
+
+// ParseTTL 从 oob 中解析 ttl, 没有找到返回 -1
+func ParseTTL(oob []byte) int {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+	for _, c := range cmsgs {
+		if len(c.Data) == 0 {
+			continue
+		}
+		if (c.Header.Level == unix.IPPROTO_IP && (c.Header.Type == unix.IP_TTL || c.Header.Type == unix.IP_RECVTTL)) ||
+			(c.Header.Level == unix.IPPROTO_IPV6 && c.Header.Type == sysIPV6_HOPLIMIT) {
+			if len(c.Data) >= 4 {
+				return int(*(*int32)(unsafe.Pointer(&c.Data[0])))
+			}
+			// darwin 的 IP_RECVTTL 只有一个字节
+			return int(c.Data[0])
+		}
+	}
+	return -1
+}
@@ -11,6 +11,7 @@ type SeqPool struct {
 	ident        map[uint16]map[uint16]interface{}
 	currentSeq   uint16
 	currentIdent uint16
+	maxSeq       uint16
 }
 
 func NewSeqPool(ident uint16) *SeqPool {
@@ -20,13 +21,19 @@ func NewSeqPool(ident uint16) *SeqPool {
 	s := &SeqPool{
 		ident:        map[uint16]map[uint16]interface{}{},
 		currentIdent: ident,
+		maxSeq:       math.MaxUint16,
 	}
 	return s
 }
 
+// SetMaxSeq seq 的上限, 例如 udp 探测的时候 seq 作为目的端口的偏移
+func (s *SeqPool) SetMaxSeq(max uint16) {
+	s.maxSeq = max
+}
+
 func (s *SeqPool) Apply(v interface{}) (uint16, uint16) {
 	seq := s.currentSeq
-	if s.currentSeq >= math.MaxUint16 {
+	if s.currentSeq >= s.maxSeq {
 		s.currentSeq = 0
 		s.currentIdent += 1
 	} else {
@@ -52,3 +59,14 @@ func (s *SeqPool) Free(ident uint16, seq uint16) interface{} {
 	}
 	return v
 }
+
+// FreeSeq 只按 seq 匹配, SOCK_DGRAM 模式下内核会把 echo 的 ident 改写成 socket 自己的 ident
+func (s *SeqPool) FreeSeq(seq uint16) interface{} {
+	// 优先匹配当前的 ident, 然后是 seq 溢出之前的 ident
+	for _, ident := range []uint16{s.currentIdent, s.currentIdent - 1} {
+		if v := s.Free(ident, seq); v != nil {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package icmp
+
+// golang.org/x/sys/unix 中没有 darwin 的 RFC 3542 常量
+const (
+	sysIPV6_RECVHOPLIMIT = 0x25
+	sysIPV6_HOPLIMIT     = 0x2f
+)
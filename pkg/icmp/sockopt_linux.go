@@ -0,0 +1,8 @@
+package icmp
+
+import "golang.org/x/sys/unix"
+
+const (
+	sysIPV6_RECVHOPLIMIT = unix.IPV6_RECVHOPLIMIT
+	sysIPV6_HOPLIMIT     = unix.IPV6_HOPLIMIT
+)
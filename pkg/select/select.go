@@ -2,13 +2,16 @@ package _select
 
 import (
 	"golang.org/x/sys/unix"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type Select struct {
-	fds  []int
-	rfds *syscall.FdSet
+	mu      sync.Mutex // 允许在 CanRead 等待的时候 Add
+	fds     []int
+	rfds    *syscall.FdSet
+	wakeFds []int // pipe, 其它 goroutine 通过 Wakeup 打断 CanRead 的等待
 }
 
 
@@ -19,9 +22,57 @@ func NewSelect() *Select {
 }
 
 func (s *Select) Add(fd int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.fds = append(s.fds, fd)
 }
 
+// EnableWakeup 创建 pipe 之后 CanRead 可以被 Wakeup 打断, 使用完需要 Close
+func (s *Select) EnableWakeup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wakeFds != nil {
+		return nil
+	}
+	fds := make([]int, 2)
+	if err := syscall.Pipe(fds); err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fds[0])
+			unix.Close(fds[1])
+			return err
+		}
+	}
+	s.wakeFds = fds
+	return nil
+}
+
+// Wakeup 打断正在等待的 CanRead, 可以在其它 goroutine 中调用
+func (s *Select) Wakeup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wakeFds != nil {
+		unix.Write(s.wakeFds[1], []byte{0})
+	}
+}
+
+func (s *Select) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wakeFds == nil {
+		return nil
+	}
+	err := unix.Close(s.wakeFds[0])
+	if cErr := unix.Close(s.wakeFds[1]); cErr != nil {
+		err = cErr
+	}
+	s.wakeFds = nil
+	return err
+}
+
 type Recv struct {
 	fd int
 }
@@ -35,8 +86,15 @@ func (r *Recv) Read(p []byte) (n int, from syscall.Sockaddr, err error) {
 
 func (s *Select) CanRead(waitTime time.Duration) (*Recv, error) {
 	var socket int
+	s.mu.Lock()
+	fds := append([]int(nil), s.fds...)
+	wakeFd := 0
+	if s.wakeFds != nil {
+		wakeFd = s.wakeFds[0]
+	}
+	s.mu.Unlock()
 	FD_ZERO(s.rfds)
-	for _, fd := range s.fds {
+	for _, fd := range append(fds, wakeFd) {
 		if fd > 0 {
 			FD_SET(s.rfds, fd)
 			if fd > socket {
@@ -55,7 +113,17 @@ selectAgain:
 			goto selectAgain
 		}
 	}
-	for _, fd := range s.fds {
+	if wakeFd > 0 && FD_ISSET(s.rfds, wakeFd) {
+		// 被 Wakeup 打断, 同超时一样处理
+		var b [64]byte
+		for {
+			if n, _ := unix.Read(wakeFd, b[:]); n <= 0 {
+				break
+			}
+		}
+		return nil, nil
+	}
+	for _, fd := range fds {
 		if fd > 0 && FD_ISSET(s.rfds, fd) {
 			return &Recv{fd}, nil
 		}
@@ -83,3 +151,9 @@ func FD_ZERO(p *syscall.FdSet) {
 		p.Bits[i] = 0
 	}
 }
+
+// ReadMsg 同 Read, 同时读取 oob 数据 (ttl 之类的控制信息)
+func (r *Recv) ReadMsg(p []byte, oob []byte) (n int, oobn int, from syscall.Sockaddr, err error) {
+	n, oobn, _, from, err = syscall.Recvmsg(r.fd, p, oob, 0)
+	return
+}
@@ -1,4 +1,5 @@
 // +build darwin,amd64
+
 package _select
 
 import "syscall"
@@ -3,7 +3,6 @@ package udp
 import (
 	"fmt"
 	"net"
-	"strings"
 )
 
 func GetLocalAddr(rAddr string) (net.IP, error) {
@@ -12,13 +11,10 @@ func GetLocalAddr(rAddr string) (net.IP, error) {
 		return nil, err
 	}
 	defer conn.Close()
-	localAddr := conn.LocalAddr().String()
-	ip := strings.Split(localAddr, ":")
-
-	if len(ip) < 1 {
+	// ipv6 地址中包含 ":", 不能通过字符串分割
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.IP == nil {
 		return nil, fmt.Errorf("local ip addr not found")
 	}
-
-	lAddr := net.ParseIP(ip[0])
-	return lAddr, nil
-}
\ No newline at end of file
+	return addr.IP, nil
+}